@@ -0,0 +1,44 @@
+package sdk
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrAuthContinue is returned by Authenticator.HandleAuthResponse when the
+// handshake needs another round: BuildAuthMessage is called again and its
+// message sent to the server.
+var ErrAuthContinue = errors.New("authentication continues")
+
+// Authenticator drives the handshake with the tunnel server. The first
+// message sent is built by BuildAuthMessage. Every server reply other than
+// TunnelCreated, TunnelAuthFailure and early requests is passed to
+// HandleAuthResponse, which returns nil to keep waiting, ErrAuthContinue to
+// send another auth message, or any other error to abort.
+type Authenticator interface {
+	BuildAuthMessage() (TunnelMessage, error)
+	HandleAuthResponse(msg TunnelMessage) error
+}
+
+// TokenAuthenticator authenticates with a static token, the default when
+// SDKConfig.Authenticator is nil. TunnelAuthResponse acknowledgements sent
+// before TunnelCreated are accepted.
+type TokenAuthenticator struct {
+	Token string
+}
+
+func (a *TokenAuthenticator) BuildAuthMessage() (TunnelMessage, error) {
+	return TunnelMessage{
+		Type: TunnelAuthRequest,
+		Body: a.Token,
+	}, nil
+}
+
+func (a *TokenAuthenticator) HandleAuthResponse(msg TunnelMessage) error {
+	// the server may acknowledge the token before creating the tunnel
+	if msg.Type == TunnelAuthResponse {
+		return nil
+	}
+
+	return fmt.Errorf("expected tunnel created message, got %d", msg.Type)
+}
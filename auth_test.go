@@ -0,0 +1,197 @@
+package sdk
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+const testAuthKey = "shared-key"
+
+func challengeResponse(nonce string) string {
+	mac := hmac.New(sha256.New, []byte(testAuthKey))
+	mac.Write([]byte(nonce))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// challengeAuthenticator first asks for a challenge, then answers it with
+// an HMAC of the nonce instead of sending a token.
+type challengeAuthenticator struct {
+	nonce  string
+	rounds int
+}
+
+func (a *challengeAuthenticator) BuildAuthMessage() (TunnelMessage, error) {
+	a.rounds++
+
+	if a.nonce == "" {
+		return TunnelMessage{Type: TunnelAuthRequest, Headers: map[string]string{"X-Auth-Step": "hello"}}, nil
+	}
+
+	return TunnelMessage{
+		Type:    TunnelAuthRequest,
+		Headers: map[string]string{"X-Auth-Step": "response"},
+		Body:    challengeResponse(a.nonce),
+	}, nil
+}
+
+func (a *challengeAuthenticator) HandleAuthResponse(msg TunnelMessage) error {
+	if msg.Type != TunnelAuthResponse || msg.Body == "" {
+		return errors.New("expected a challenge")
+	}
+
+	a.nonce = msg.Body
+
+	return ErrAuthContinue
+}
+
+// acceptChallenge creates the tunnel once the client answered a challenge.
+func acceptChallenge(fc *fakeConn) error {
+	hello, err := fc.readAuth()
+	if err != nil {
+		return err
+	}
+
+	if hello.Headers["X-Auth-Step"] != "hello" {
+		return errTestRefused
+	}
+
+	const nonce = "nonce-123"
+	if err := fc.send(TunnelMessage{Type: TunnelAuthResponse, Body: nonce}); err != nil {
+		return err
+	}
+
+	response, err := fc.readAuth()
+	if err != nil {
+		return err
+	}
+
+	if response.Headers["X-Auth-Step"] != "response" || response.Body != challengeResponse(nonce) {
+		return fc.send(TunnelMessage{Type: TunnelAuthFailure, Body: "bad challenge response"})
+	}
+
+	fc.auth = response
+
+	return fc.send(tunnelCreated("tunnel-1"))
+}
+
+func TestCustomAuthenticatorChallengeResponse(t *testing.T) {
+	server := newFakeServerWith(t, acceptChallenge)
+
+	auth := &challengeAuthenticator{}
+	sdkConfig := testSDKConfig(server)
+	sdkConfig.Authenticator = auth
+
+	conn, err := NewTunnelConn(testConfig(), sdkConfig, "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startTunnel(t, server, conn)
+
+	if auth.rounds != 2 {
+		t.Errorf("authenticator built %d messages, want 2", auth.rounds)
+	}
+
+	if conn.TunnelID() != "tunnel-1" {
+		t.Errorf("TunnelID = %q, want tunnel-1", conn.TunnelID())
+	}
+}
+
+func TestOnBeforeAuth(t *testing.T) {
+	server := newFakeServer(t)
+
+	sdkConfig := testSDKConfig(server)
+	sdkConfig.OnBeforeAuth = func(token string) (string, error) {
+		return token + ":scope=read", nil
+	}
+
+	conn, err := NewTunnelConn(testConfig(), sdkConfig, "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fc := startTunnel(t, server, conn)
+	if fc.auth.Body != "token:scope=read" {
+		t.Errorf("server got token %q, want the one from OnBeforeAuth", fc.auth.Body)
+	}
+
+	errVeto := errors.New("token revoked")
+	sdkConfig = testSDKConfig(server)
+	sdkConfig.OnBeforeAuth = func(token string) (string, error) {
+		return "", errVeto
+	}
+
+	vetoed, err := NewTunnelConn(testConfig(), sdkConfig, "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vetoed.Stop()
+
+	if err := vetoed.Connect(); !errors.Is(err, errVeto) {
+		t.Errorf("Connect = %v, want the OnBeforeAuth error", err)
+	}
+
+	if vetoed.Status() == StatusConnected {
+		t.Error("connected although OnBeforeAuth refused")
+	}
+}
+
+func TestAuthResponseBeforeTunnelCreated(t *testing.T) {
+	server := newFakeServerWith(t, func(fc *fakeConn) error {
+		if _, err := fc.readAuth(); err != nil {
+			return err
+		}
+
+		ack := TunnelMessage{Type: TunnelAuthResponse, Headers: map[string]string{"X-Account": "acme"}}
+		if err := fc.send(ack); err != nil {
+			return err
+		}
+
+		return fc.send(tunnelCreated("tunnel-1"))
+	})
+
+	conn, err := NewTunnelConn(testConfig(), testSDKConfig(server), "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startTunnel(t, server, conn)
+
+	if conn.TunnelID() != "tunnel-1" {
+		t.Errorf("TunnelID = %q, want tunnel-1", conn.TunnelID())
+	}
+
+	if account := conn.AuthResponse().Headers["X-Account"]; account != "acme" {
+		t.Errorf("AuthResponse account = %q, want acme", account)
+	}
+}
+
+func TestAuthFailureReportsReason(t *testing.T) {
+	server := newFakeServerWith(t, refuseAuth)
+
+	var reported []error
+	sdkConfig := testSDKConfig(server)
+	sdkConfig.OnError = func(err error) {
+		reported = append(reported, err)
+	}
+
+	conn, err := NewTunnelConn(testConfig(), sdkConfig, "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Stop()
+
+	err = conn.Connect()
+	if !errors.Is(err, ErrAuthFailure) || !strings.Contains(err.Error(), "invalid token") {
+		t.Fatalf("Connect() = %v, want ErrAuthFailure with the reason", err)
+	}
+
+	if len(reported) == 0 || !errors.Is(reported[0], ErrAuthFailure) {
+		t.Errorf("OnError got %v, want the auth failure", reported)
+	}
+}
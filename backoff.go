@@ -0,0 +1,112 @@
+package sdk
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// BackoffJitter selects how reconnect delays are randomized so that many
+// clients dropped at once don't reconnect in lockstep.
+type BackoffJitter int
+
+const (
+	// BackoffFullJitter waits a random delay between zero and the
+	// exponential backoff.
+	BackoffFullJitter BackoffJitter = iota
+	// BackoffNoJitter waits exactly the exponential backoff.
+	BackoffNoJitter
+	// BackoffEqualJitter waits half the exponential backoff plus a random
+	// delay up to the other half.
+	BackoffEqualJitter
+	// BackoffDecorrelatedJitter waits a random delay between the base and
+	// three times the previous delay.
+	BackoffDecorrelatedJitter
+)
+
+// backoffDelay returns the delay before reconnect attempt (starting at 0),
+// growing exponentially from base and capped at max. prev is the delay used
+// for the previous attempt, needed by decorrelated jitter.
+func backoffDelay(jitter BackoffJitter, base, max time.Duration, attempt int, prev time.Duration) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+
+	if jitter == BackoffDecorrelatedJitter {
+		upper := 3 * prev
+		if upper < base {
+			upper = base
+		}
+
+		return min(base+randDuration(upper-base), max)
+	}
+
+	delay := base
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+
+	delay = min(delay, max)
+
+	switch jitter {
+	case BackoffNoJitter:
+		return delay
+	case BackoffEqualJitter:
+		return delay/2 + randDuration(delay-delay/2)
+	default:
+		return randDuration(delay)
+	}
+}
+
+// randDuration returns a random duration in [0, d].
+func randDuration(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+
+	return rand.N(d + 1)
+}
+
+// retryBudget is a token bucket bounding reconnect attempts over time,
+// holding up to size attempts and refilled by one every refill.
+type retryBudget struct {
+	mu     sync.Mutex
+	size   float64
+	refill time.Duration
+	tokens float64
+	last   time.Time
+}
+
+func newRetryBudget(size int, refill time.Duration) *retryBudget {
+	if refill <= 0 {
+		refill = DefaultRetryBudgetRefill
+	}
+
+	return &retryBudget{
+		size:   float64(size),
+		refill: refill,
+		tokens: float64(size),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes an attempt from the budget and returns how long to wait
+// before making it, zero until the budget is exhausted.
+func (b *retryBudget) reserve(now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = min(b.size, b.tokens+float64(now.Sub(b.last))/float64(b.refill))
+	b.last = now
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens * float64(b.refill))
+}
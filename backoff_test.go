@@ -0,0 +1,114 @@
+package sdk
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoffJitterBounds(t *testing.T) {
+	const (
+		base       = 100 * time.Millisecond
+		maxDelay   = 5 * time.Second
+		iterations = 1000
+	)
+
+	// the exponential delay of attempt before jitter
+	exponential := func(attempt int) time.Duration {
+		return min(base<<attempt, maxDelay)
+	}
+
+	tests := []struct {
+		name   string
+		jitter BackoffJitter
+		bounds func(attempt int) (time.Duration, time.Duration)
+	}{
+		{"none", BackoffNoJitter, func(attempt int) (time.Duration, time.Duration) {
+			return exponential(attempt), exponential(attempt)
+		}},
+		{"full", BackoffFullJitter, func(attempt int) (time.Duration, time.Duration) {
+			return 0, exponential(attempt)
+		}},
+		{"equal", BackoffEqualJitter, func(attempt int) (time.Duration, time.Duration) {
+			return exponential(attempt) / 2, exponential(attempt)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for attempt := 0; attempt < 8; attempt++ {
+				low, high := tt.bounds(attempt)
+
+				distinct := make(map[time.Duration]bool)
+				for i := 0; i < iterations; i++ {
+					delay := backoffDelay(tt.jitter, base, maxDelay, attempt, 0)
+					if delay < low || delay > high {
+						t.Fatalf("attempt %d delay %v outside [%v, %v]", attempt, delay, low, high)
+					}
+
+					distinct[delay] = true
+				}
+
+				if tt.jitter != BackoffNoJitter && len(distinct) < iterations/2 {
+					t.Errorf("attempt %d gave only %d distinct delays, jitter looks broken", attempt, len(distinct))
+				}
+			}
+		})
+	}
+
+	t.Run("decorrelated", func(t *testing.T) {
+		var prev time.Duration
+		for i := 0; i < iterations; i++ {
+			delay := backoffDelay(BackoffDecorrelatedJitter, base, maxDelay, i, prev)
+
+			high := min(max(3*prev, base), maxDelay)
+			if delay < base || delay > high {
+				t.Fatalf("delay %v after %v outside [%v, %v]", delay, prev, base, high)
+			}
+
+			prev = delay
+		}
+	})
+
+	if delay := backoffDelay(BackoffFullJitter, 0, maxDelay, 3, 0); delay != 0 {
+		t.Errorf("delay with no base = %v, want 0", delay)
+	}
+}
+
+func TestRetryBudgetBoundsOutage(t *testing.T) {
+	const outage = 500 * time.Millisecond
+
+	var attempts atomic.Int32
+	server := newFakeServerWith(t, func(fc *fakeConn) error {
+		attempts.Add(1)
+		return refuseAuth(fc)
+	})
+
+	config := testConfig()
+	config.AutoReconnect = true
+	config.ReconnectBackoff = time.Millisecond
+	config.BackoffJitter = BackoffNoJitter
+	config.RetryBudget = 2
+	config.RetryBudgetRefill = 250 * time.Millisecond
+
+	conn, err := NewTunnelConn(config, testSDKConfig(server), "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan error, 1)
+	go func() {
+		started <- conn.Start()
+	}()
+
+	time.Sleep(outage)
+	conn.Stop()
+	<-started
+
+	// the first connect, the initial budget and what refilled meanwhile;
+	// the backoff alone would allow about twice as many
+	budget := 1 + config.RetryBudget + int(outage/config.RetryBudgetRefill)
+	if n := int(attempts.Load()); n > budget {
+		t.Errorf("%d connection attempts during a %v outage, want at most %d", n, outage, budget)
+	}
+}
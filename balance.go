@@ -0,0 +1,94 @@
+package sdk
+
+import (
+	"sync"
+	"time"
+)
+
+// backendCooldown is how long a backend that failed to answer is skipped.
+const backendCooldown = 10 * time.Second
+
+// WeightedBackend is one of several local instances sharing the traffic of
+// a tunnel in proportion to its Weight.
+type WeightedBackend struct {
+	Host   string
+	Port   string
+	Weight int
+}
+
+type backendState struct {
+	WeightedBackend
+
+	current   int
+	downUntil time.Time
+}
+
+// backendPool picks backends by smooth weighted round-robin, skipping the
+// ones that failed recently unless all of them did.
+type backendPool struct {
+	mu       sync.Mutex
+	backends []*backendState
+}
+
+func newBackendPool(backends []WeightedBackend) *backendPool {
+	pool := &backendPool{}
+	for _, backend := range backends {
+		if backend.Host == "" {
+			backend.Host = DefaultLocalHost
+		}
+
+		if backend.Weight <= 0 {
+			backend.Weight = 1
+		}
+
+		pool.backends = append(pool.backends, &backendState{WeightedBackend: backend})
+	}
+
+	return pool
+}
+
+func (p *backendPool) pick() *backendState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if best := p.pickFrom(now, true); best != nil {
+		return best
+	}
+
+	// every backend failed recently, try them anyway rather than failing
+	return p.pickFrom(now, false)
+}
+
+func (p *backendPool) pickFrom(now time.Time, healthyOnly bool) *backendState {
+	var (
+		best  *backendState
+		total int
+	)
+
+	for _, backend := range p.backends {
+		if healthyOnly && now.Before(backend.downUntil) {
+			continue
+		}
+
+		backend.current += backend.Weight
+		total += backend.Weight
+
+		if best == nil || backend.current > best.current {
+			best = backend
+		}
+	}
+
+	if best != nil {
+		best.current -= total
+	}
+
+	return best
+}
+
+func (p *backendPool) markFailed(backend *backendState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	backend.downUntil = time.Now().Add(backendCooldown)
+}
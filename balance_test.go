@@ -0,0 +1,61 @@
+package sdk
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestWeightedBackendsShareTraffic(t *testing.T) {
+	backend := func(name string) string {
+		return backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+	}
+
+	config := testConfig()
+	config.Backends = []WeightedBackend{
+		{Host: "127.0.0.1", Port: backend("heavy"), Weight: 3},
+		{Host: "127.0.0.1", Port: backend("light"), Weight: 1},
+	}
+
+	_, fc := newTestTunnel(t, config, "8080")
+
+	const requests = 40
+	served := make(map[string]int)
+	for i := 0; i < requests; i++ {
+		resp := fc.request(TunnelMessage{ID: fmt.Sprint(i), Method: http.MethodGet, Path: "/"})
+		served[resp.Body]++
+	}
+
+	if served["heavy"] != 30 || served["light"] != 10 {
+		t.Errorf("served %v, want 30 heavy and 10 light for weights 3:1", served)
+	}
+}
+
+func TestFailedBackendSkipped(t *testing.T) {
+	healthy := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "healthy")
+	}))
+
+	config := testConfig()
+	config.Backends = []WeightedBackend{
+		{Host: "127.0.0.1", Port: closedPort(t), Weight: 5},
+		{Host: "127.0.0.1", Port: healthy, Weight: 1},
+	}
+
+	_, fc := newTestTunnel(t, config, "8080")
+
+	resp := fc.request(TunnelMessage{ID: "0", Method: http.MethodGet, Path: "/"})
+	if status := statusCode(t, resp); status != http.StatusBadGateway {
+		t.Fatalf("first request answered %d, want 502 from the dead backend", status)
+	}
+
+	for i := 1; i <= 5; i++ {
+		resp := fc.request(TunnelMessage{ID: fmt.Sprint(i), Method: http.MethodGet, Path: "/"})
+		if status := statusCode(t, resp); status != http.StatusOK || resp.Body != "healthy" {
+			t.Errorf("request %d answered %d %q, want the healthy backend", i, status, resp.Body)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"unicode/utf8"
+)
+
+// readBody reads body until EOF or until ctx is done. Cancelling ctx closes
+// the body to unblock a pending read; the bytes read so far are returned
+// along with the context error so they can still be forwarded.
+func readBody(ctx context.Context, body io.ReadCloser) ([]byte, error) {
+	stop := context.AfterFunc(ctx, func() {
+		body.Close()
+	})
+	defer stop()
+
+	data, err := io.ReadAll(body)
+	if err != nil && ctx.Err() != nil {
+		return data, ctx.Err()
+	}
+
+	return data, err
+}
+
+// spilledBody is a response body buffered in a temporary file.
+type spilledBody struct {
+	*os.File
+	size int64
+}
+
+// Close closes and removes the temporary file.
+func (b *spilledBody) Close() error {
+	err := b.File.Close()
+	os.Remove(b.Name())
+
+	return err
+}
+
+// readBodySpilling reads body like readBody, but holds at most threshold
+// bytes in memory, reserved from buffers. A larger body is written to a
+// temporary file in dir and returned rewound as spilled, which the caller
+// closes. The bytes read before an error are kept in either case.
+func readBodySpilling(ctx context.Context, body io.ReadCloser, threshold int64, dir string, buffers *bufferReservation) ([]byte, *spilledBody, error) {
+	stop := context.AfterFunc(ctx, func() {
+		body.Close()
+	})
+	defer stop()
+
+	var head bytes.Buffer
+	_, err := io.CopyN(&head, &budgetReader{ReadCloser: body, reservation: buffers}, threshold+1)
+	if int64(head.Len()) <= threshold {
+		if err == io.EOF {
+			err = nil
+		}
+
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+
+		return head.Bytes(), nil, err
+	}
+
+	file, err := os.CreateTemp(dir, "letngorok-body-*")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	spilled := &spilledBody{File: file}
+	spilled.size, err = io.Copy(file, io.MultiReader(&head, body))
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+
+	if _, seekErr := file.Seek(0, io.SeekStart); seekErr != nil {
+		spilled.Close()
+		return nil, nil, seekErr
+	}
+
+	return nil, spilled, err
+}
+
+// encodeBody base64 encodes the body of msg when it isn't valid UTF-8, which
+// JSON would otherwise mangle.
+func encodeBody(msg *TunnelMessage) {
+	if msg.BodyEncoding != "" || utf8.ValidString(msg.Body) {
+		return
+	}
+
+	msg.Body = base64.StdEncoding.EncodeToString([]byte(msg.Body))
+	msg.BodyEncoding = BodyEncodingBase64
+}
+
+// decodeBody replaces an encoded body of msg by the raw bytes.
+func decodeBody(msg *TunnelMessage) error {
+	switch msg.BodyEncoding {
+	case "":
+		return nil
+	case BodyEncodingBase64:
+		body, err := base64.StdEncoding.DecodeString(msg.Body)
+		if err != nil {
+			return fmt.Errorf("invalid base64 body: %w", err)
+		}
+
+		msg.Body = string(body)
+		msg.BodyEncoding = ""
+		return nil
+	default:
+		return errors.New("unsupported body encoding: " + msg.BodyEncoding)
+	}
+}
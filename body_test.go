@@ -0,0 +1,153 @@
+package sdk
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBinaryBodiesRoundTrip(t *testing.T) {
+	payload := make([]byte, 256)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	received := make(chan []byte, 1)
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- body
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(body)
+	}))
+
+	_, fc := newTestTunnel(t, nil, port)
+
+	err := fc.send(TunnelMessage{
+		Type:         TunnelRequest,
+		ID:           "1",
+		Method:       http.MethodPost,
+		Path:         "/",
+		Body:         base64.StdEncoding.EncodeToString(payload),
+		BodyEncoding: BodyEncodingBase64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body := <-received; !bytes.Equal(body, payload) {
+		t.Errorf("backend got %d bytes differing from the 256 byte values", len(body))
+	}
+
+	// read the response as sent, before any decoding
+	resp := fc.recv()
+	if resp.BodyEncoding != BodyEncodingBase64 {
+		t.Fatalf("binary response sent with body encoding %q", resp.BodyEncoding)
+	}
+
+	if err := decodeBody(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal([]byte(resp.Body), payload) {
+		t.Error("response body differs from the 256 byte values")
+	}
+}
+
+func TestTextBodiesStayPlain(t *testing.T) {
+	msg := TunnelMessage{Body: "héllo, tunnel"}
+	encodeBody(&msg)
+
+	if msg.BodyEncoding != "" || msg.Body != "héllo, tunnel" {
+		t.Errorf("UTF-8 body encoded as %q %q", msg.BodyEncoding, msg.Body)
+	}
+
+	if err := decodeBody(&TunnelMessage{Body: "x", BodyEncoding: "rot13"}); err == nil {
+		t.Error("unknown body encoding accepted")
+	}
+}
+
+func TestLargeResponseSpilledToDisk(t *testing.T) {
+	const threshold = 64 * 1024
+
+	payload := make([]byte, 4*threshold)
+	for i := range payload {
+		payload[i] = byte(i % 251)
+	}
+
+	checked := make(chan struct{})
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+
+		// past the threshold, then wait for the test to see the file
+		w.Write(payload[:2*threshold])
+		w.(http.Flusher).Flush()
+		<-checked
+		w.Write(payload[2*threshold:])
+	}))
+
+	dir := t.TempDir()
+
+	config := testConfig()
+	config.BufferSpillThreshold = threshold
+	config.BufferSpillDir = dir
+
+	_, fc := newTestTunnel(t, config, port)
+
+	if err := fc.send(TunnelMessage{Type: TunnelRequest, ID: "1", Method: http.MethodGet, Path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool {
+		entries, _ := os.ReadDir(dir)
+		return len(entries) == 1
+	})
+	close(checked)
+
+	resp := fc.response("1")
+	if status := statusCode(t, resp); status != http.StatusOK || !bytes.Equal([]byte(resp.Body), payload) {
+		t.Errorf("spilled response answered %d with %d bytes, want 200 with the %d sent", status, len(resp.Body), len(payload))
+	}
+
+	waitFor(t, func() bool {
+		entries, _ := os.ReadDir(dir)
+		return len(entries) == 0
+	})
+}
+
+func TestSpilledResponseTransformed(t *testing.T) {
+	body := strings.Repeat("spill ", 1000)
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, body)
+	}))
+
+	dir := t.TempDir()
+
+	config := testConfig()
+	config.BufferSpillThreshold = 1024
+	config.BufferSpillDir = dir
+	config.ResponseTransformers = map[string]func([]byte, map[string]string) []byte{
+		"text/plain": func(body []byte, headers map[string]string) []byte {
+			return bytes.ToUpper(body)
+		},
+	}
+
+	_, fc := newTestTunnel(t, config, port)
+
+	resp := fc.request(TunnelMessage{ID: "1", Method: http.MethodGet, Path: "/"})
+	if want := strings.ToUpper(body); resp.Body != want {
+		t.Errorf("got %d bytes, want the %d transformed ones", len(resp.Body), len(want))
+	}
+
+	waitFor(t, func() bool {
+		entries, _ := os.ReadDir(dir)
+		return len(entries) == 0
+	})
+}
@@ -0,0 +1,72 @@
+package sdk
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+var errBufferLimit = errors.New("buffered bytes limit reached")
+
+// bufferBudget caps the request and response bytes held in memory by all
+// the requests of a tunnel together.
+type bufferBudget struct {
+	max  int64
+	used atomic.Int64
+}
+
+func (b *bufferBudget) reserve(n int64) bool {
+	for {
+		used := b.used.Load()
+		if used+n > b.max {
+			return false
+		}
+
+		if b.used.CompareAndSwap(used, used+n) {
+			return true
+		}
+	}
+}
+
+// bufferReservation is the share of the budget held by one request, given
+// back all at once when the request completes.
+type bufferReservation struct {
+	budget *bufferBudget
+	n      int64
+}
+
+func (r *bufferReservation) reserve(n int64) bool {
+	if r == nil {
+		return true
+	}
+
+	if !r.budget.reserve(n) {
+		return false
+	}
+
+	r.n += n
+	return true
+}
+
+func (r *bufferReservation) release() {
+	if r != nil {
+		r.budget.used.Add(-r.n)
+		r.n = 0
+	}
+}
+
+// budgetReader reserves the bytes read from a response body, failing with
+// errBufferLimit once the budget is exhausted.
+type budgetReader struct {
+	io.ReadCloser
+	reservation *bufferReservation
+}
+
+func (r *budgetReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 && !r.reservation.reserve(int64(n)) {
+		return 0, errBufferLimit
+	}
+
+	return n, err
+}
@@ -0,0 +1,100 @@
+package sdk
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMaxTotalBufferedBytesBoundsConcurrentResponses(t *testing.T) {
+	const (
+		requests = 4
+		head     = 600 * 1024
+		tail     = 400 * 1024
+		limit    = 2 * 1024 * 1024
+	)
+
+	var arrived atomic.Int32
+	release := make(chan struct{})
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(head+tail))
+		w.Write([]byte(strings.Repeat("a", head)))
+		w.(http.Flusher).Flush()
+
+		if r.URL.Path == "/held" {
+			arrived.Add(1)
+			<-release
+		}
+
+		w.Write([]byte(strings.Repeat("b", tail)))
+	}))
+
+	config := testConfig()
+	config.MaxTotalBufferedBytes = limit
+
+	conn, fc := newTestTunnel(t, config, port)
+
+	var peak atomic.Int64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			if used := conn.buffers.used.Load(); used > peak.Load() {
+				peak.Store(used)
+			}
+		}
+	}()
+
+	for i := 0; i < requests; i++ {
+		msg := TunnelMessage{Type: TunnelRequest, ID: fmt.Sprint(i), Method: http.MethodGet, Path: "/held"}
+		if err := fc.send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool { return arrived.Load() == requests })
+
+	// the heads alone exceed the limit, so one response is dropped while
+	// the others are held
+	first := fc.recv()
+	if code := statusCode(t, first); code != http.StatusServiceUnavailable {
+		t.Errorf("first response got %d, want 503", code)
+	}
+
+	close(release)
+
+	for id, resp := range fc.responses(requests - 1) {
+		switch code := statusCode(t, resp); code {
+		case http.StatusOK:
+			if len(resp.Body) != head+tail {
+				t.Errorf("response %s has %d bytes, want %d", id, len(resp.Body), head+tail)
+			}
+		case http.StatusServiceUnavailable:
+		default:
+			t.Errorf("response %s got %d, want 200 or 503", id, code)
+		}
+	}
+
+	close(done)
+	<-sampled
+
+	if p := peak.Load(); p > limit {
+		t.Errorf("%d bytes buffered at once, want at most %d", p, limit)
+	}
+
+	waitFor(t, func() bool { return conn.buffers.used.Load() == 0 })
+
+	resp := fc.request(TunnelMessage{ID: "after", Method: http.MethodGet, Path: "/"})
+	if code := statusCode(t, resp); code != http.StatusOK || len(resp.Body) != head+tail {
+		t.Errorf("request after the others got %d with %d bytes, want the whole body", code, len(resp.Body))
+	}
+}
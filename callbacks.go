@@ -0,0 +1,102 @@
+package sdk
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Callbacks is the set of event callbacks of an SDKConfig. It can be swapped
+// as a whole while tunnels are running with UpdateCallbacks.
+type Callbacks struct {
+	OnAuth             func(token string)
+	OnConnected        func(localPort, localUrl, prodUrl, tunnelId string)
+	OnDisconnected     func()
+	OnError            func(err error)
+	OnRequest          func(msg TunnelMessage)
+	OnSedingResponse   func(msg TunnelMessage, resp *http.Response, body []byte)
+	OnMessageAfterStop func(msg TunnelMessage)
+	OnBeforeAuth       func(token string) (string, error)
+	OnShutdown         func(report ShutdownReport)
+	OnReconnect        func(attempt int, localPort string) string
+}
+
+type callbackStore struct {
+	mu        sync.RWMutex
+	callbacks Callbacks
+}
+
+// initCallbacks snapshots the On* fields into the store read by running
+// tunnels. It must run before any tunnel goroutine starts.
+func (c *SDKConfig) initCallbacks() {
+	if c.callbacks != nil {
+		return
+	}
+
+	c.callbacks = &callbackStore{
+		callbacks: Callbacks{
+			OnAuth:             c.OnAuth,
+			OnConnected:        c.OnConnected,
+			OnDisconnected:     c.OnDisconnected,
+			OnError:            c.OnError,
+			OnRequest:          c.OnRequest,
+			OnSedingResponse:   c.OnSedingResponse,
+			OnMessageAfterStop: c.OnMessageAfterStop,
+			OnBeforeAuth:       c.OnBeforeAuth,
+			OnShutdown:         c.OnShutdown,
+			OnReconnect:        c.OnReconnect,
+		},
+	}
+}
+
+func (c *SDKConfig) currentCallbacks() Callbacks {
+	c.callbacks.mu.RLock()
+	defer c.callbacks.mu.RUnlock()
+
+	return c.callbacks.callbacks
+}
+
+// updateCallbacks lets update modify a copy of the callbacks and installs
+// it atomically. Nil callbacks keep their previous value, except the
+// optional ones, from OnMessageAfterStop on, which are cleared.
+func (c *SDKConfig) updateCallbacks(update func(*Callbacks)) {
+	c.callbacks.mu.Lock()
+	defer c.callbacks.mu.Unlock()
+
+	callbacks := c.callbacks.callbacks
+	update(&callbacks)
+
+	current := c.callbacks.callbacks
+	if callbacks.OnAuth == nil {
+		callbacks.OnAuth = current.OnAuth
+	}
+	if callbacks.OnConnected == nil {
+		callbacks.OnConnected = current.OnConnected
+	}
+	if callbacks.OnDisconnected == nil {
+		callbacks.OnDisconnected = current.OnDisconnected
+	}
+	if callbacks.OnError == nil {
+		callbacks.OnError = current.OnError
+	}
+	if callbacks.OnRequest == nil {
+		callbacks.OnRequest = current.OnRequest
+	}
+	if callbacks.OnSedingResponse == nil {
+		callbacks.OnSedingResponse = current.OnSedingResponse
+	}
+
+	c.callbacks.callbacks = callbacks
+}
+
+// UpdateCallbacks atomically replaces the callbacks used by the client's
+// tunnels, including running ones. The On* fields of the SDKConfig are not
+// read again once the client is created, so use this to change them.
+func (c *TunnelClient) UpdateCallbacks(update func(*Callbacks)) {
+	c.config.updateCallbacks(update)
+}
+
+// UpdateCallbacks atomically replaces the callbacks used by the tunnel.
+// They are shared with every tunnel using the same SDKConfig.
+func (c *TunnelConn) UpdateCallbacks(update func(*Callbacks)) {
+	c.sdkConfig.updateCallbacks(update)
+}
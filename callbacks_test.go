@@ -0,0 +1,69 @@
+package sdk
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestUpdateCallbacksWhileForwarding(t *testing.T) {
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	config := testConfig()
+	config.MaxConcurrentRequests = 64
+
+	conn, fc := newTestTunnel(t, config, port)
+
+	const requests = 200
+
+	var (
+		seen [2]atomic.Int32
+		wg   sync.WaitGroup
+	)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < requests; i++ {
+			if err := fc.send(TunnelMessage{Type: TunnelRequest, ID: fmt.Sprint(i), Method: http.MethodGet, Path: "/"}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	// swap the callbacks back and forth while the requests are handled
+	for i := 0; i < 50; i++ {
+		current := i % 2
+		conn.UpdateCallbacks(func(callbacks *Callbacks) {
+			callbacks.OnRequest = func(msg TunnelMessage) {
+				seen[current].Add(1)
+			}
+		})
+	}
+
+	fc.responses(requests)
+	wg.Wait()
+
+	if total := seen[0].Load() + seen[1].Load(); total > requests {
+		t.Errorf("callbacks saw %d requests, more than the %d sent", total, requests)
+	}
+
+	// once swapped, only the new callback runs
+	var latest atomic.Int32
+	conn.UpdateCallbacks(func(callbacks *Callbacks) {
+		callbacks.OnRequest = func(msg TunnelMessage) {
+			latest.Add(1)
+		}
+	})
+
+	before := seen[0].Load() + seen[1].Load()
+	fc.request(TunnelMessage{ID: "last", Method: http.MethodGet, Path: "/"})
+
+	if latest.Load() != 1 || seen[0].Load()+seen[1].Load() != before {
+		t.Errorf("request after the last update reached %d new and %d old callbacks", latest.Load(), seen[0].Load()+seen[1].Load()-before)
+	}
+}
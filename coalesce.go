@@ -0,0 +1,201 @@
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errNotShared tells the callers of a flight that didn't start it that the
+// response wasn't shared and they must make their own round trip.
+var errNotShared = errors.New("response not shared")
+
+// flightGroup shares one local round trip between concurrent identical
+// requests, like golang.org/x/sync/singleflight.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	resp *http.Response
+	body []byte
+	err  error
+
+	// unshared is set when resp is streamed rather than buffered. Its body,
+	// left unread, goes to the caller that started the call, or is closed
+	// when that caller stopped waiting.
+	unshared bool
+
+	mu        sync.Mutex
+	finished  bool
+	abandoned bool
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[string]*flightCall)}
+}
+
+// do runs fetch once for every concurrent caller with the same key and
+// gives each caller its own copy of the response. A caller whose ctx is
+// done stops waiting without affecting the others. When fetch reports the
+// response can't be shared, only the caller that started the call gets it
+// and the others get errNotShared.
+func (g *flightGroup) do(ctx context.Context, key string, fetch func() (resp *http.Response, body []byte, shared bool, err error)) (*http.Response, error) {
+	g.mu.Lock()
+	call, ok := g.calls[key]
+	if !ok {
+		call = &flightCall{done: make(chan struct{})}
+		g.calls[key] = call
+		g.mu.Unlock()
+
+		go func() {
+			resp, body, shared, err := fetch()
+
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+
+			call.mu.Lock()
+			call.resp, call.body, call.err = resp, body, err
+			call.unshared = err == nil && !shared
+			call.finished = true
+			if call.unshared && call.abandoned {
+				resp.Body.Close()
+			}
+			call.mu.Unlock()
+
+			close(call.done)
+		}()
+	} else {
+		g.mu.Unlock()
+	}
+
+	select {
+	case <-ctx.Done():
+		if !ok {
+			call.abandon()
+		}
+
+		return nil, ctx.Err()
+	case <-call.done:
+	}
+
+	if call.err != nil {
+		return nil, call.err
+	}
+
+	if call.unshared {
+		if ok {
+			return nil, errNotShared
+		}
+
+		// the body is read after do returns, stop it with the request
+		context.AfterFunc(ctx, func() {
+			call.resp.Body.Close()
+		})
+
+		return call.resp, nil
+	}
+
+	resp := *call.resp
+	resp.Header = call.resp.Header.Clone()
+	resp.Body = io.NopCloser(bytes.NewReader(call.body))
+
+	return &resp, nil
+}
+
+// abandon records that the caller that started the call stopped waiting,
+// closing an unshared response nobody will read.
+func (c *flightCall) abandon() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.abandoned = true
+	if c.finished && c.unshared {
+		c.resp.Body.Close()
+	}
+}
+
+// coalescable reports whether req may share its response with concurrent
+// identical requests.
+func coalescable(req *http.Request) bool {
+	return (req.Method == http.MethodGet || req.Method == http.MethodHead) && req.ContentLength == 0
+}
+
+// coalescedRoundTrip forwards req through the flight group, detached from
+// the request's own cancellation since other requests may be waiting on it.
+// The shared round trip is bounded by the request timeout instead, so a
+// stalled body doesn't hold back later identical requests. A response to be
+// streamed isn't shared, the other requests forward their own.
+func (c *TunnelConn) coalescedRoundTrip(req *http.Request, key string) (*http.Response, error) {
+	resp, err := c.flights.do(req.Context(), key, func() (*http.Response, []byte, bool, error) {
+		ctx, cancel := context.WithCancelCause(context.WithoutCancel(req.Context()))
+
+		stopDeadline := func() bool { return true }
+		if timeout := c.requestTimeout(); timeout > 0 {
+			timer := time.AfterFunc(timeout, func() {
+				cancel(context.DeadlineExceeded)
+			})
+			stopDeadline = timer.Stop
+		}
+
+		resp, err := c.roundTrip(req.Clone(ctx))
+		if err != nil {
+			cancel(nil)
+			return nil, nil, false, fetchError(ctx, err)
+		}
+
+		if c.shouldStream(resp) {
+			// like any stream, it may outlive the timeout
+			stopDeadline()
+			resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: func() { cancel(nil) }}
+
+			return resp, nil, false, nil
+		}
+
+		defer cancel(nil)
+		defer resp.Body.Close()
+
+		body, err := readBody(ctx, resp.Body)
+		if err != nil {
+			return nil, nil, false, fetchError(ctx, err)
+		}
+
+		return resp, body, true, nil
+	})
+
+	if errors.Is(err, errNotShared) {
+		return c.roundTrip(req)
+	}
+
+	return resp, err
+}
+
+// fetchError reports a shared round trip cut by its timeout as
+// context.DeadlineExceeded, answered like any local timeout.
+func fetchError(ctx context.Context, err error) error {
+	if errors.Is(context.Cause(ctx), context.DeadlineExceeded) {
+		return context.DeadlineExceeded
+	}
+
+	return err
+}
+
+// cancelOnClose cancels the context of a response when its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+
+	return err
+}
@@ -0,0 +1,137 @@
+package sdk
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConcurrentIdenticalGETsCoalesced(t *testing.T) {
+	const requests = 50
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+
+		io.WriteString(w, "report "+r.URL.Query().Get("year"))
+	}))
+
+	config := testConfig()
+	config.CoalesceRequests = true
+	config.MaxConcurrentRequests = requests
+
+	conn, fc := newTestTunnel(t, config, port)
+
+	for i := 0; i < requests; i++ {
+		msg := TunnelMessage{Type: TunnelRequest, ID: fmt.Sprint(i), Method: http.MethodGet, Path: "/report?year=2026"}
+		if err := fc.send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// every request waits on the backend before it answers
+	waitFor(t, func() bool { return len(conn.InFlight()) == requests })
+	close(release)
+
+	for id, resp := range fc.responses(requests) {
+		if status := statusCode(t, resp); status != http.StatusOK || resp.Body != "report 2026" {
+			t.Errorf("request %s answered %d %q", id, status, resp.Body)
+		}
+	}
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("backend called %d times for %d identical GETs, want 1", n, requests)
+	}
+
+	// other queries and methods aren't shared
+	fc.request(TunnelMessage{ID: "other", Method: http.MethodGet, Path: "/report?year=2025"})
+	fc.request(TunnelMessage{ID: "post", Method: http.MethodPost, Path: "/report?year=2026", Body: "x"})
+
+	if n := calls.Load(); n != 3 {
+		t.Errorf("backend called %d times in all, want 3", n)
+	}
+}
+
+func TestStalledCoalescedResponseExpires(t *testing.T) {
+	var calls atomic.Int32
+	stalled := make(chan struct{})
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			// the headers go out, the body never comes
+			w.Header().Set("Content-Length", "100")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-stalled
+			return
+		}
+
+		io.WriteString(w, "fresh")
+	}))
+	// registered after the backend so it runs before backend.Close waits
+	t.Cleanup(func() { close(stalled) })
+
+	config := testConfig()
+	config.CoalesceRequests = true
+	config.RequestTimeout = 200 * time.Millisecond
+
+	_, fc := newTestTunnel(t, config, port)
+
+	resp := fc.request(TunnelMessage{ID: "stalled", Method: http.MethodGet, Path: "/report"})
+	if status := statusCode(t, resp); status != http.StatusGatewayTimeout {
+		t.Errorf("stalled request answered %d, want 504", status)
+	}
+
+	for _, id := range []string{"2", "3"} {
+		resp := fc.request(TunnelMessage{ID: id, Method: http.MethodGet, Path: "/report"})
+		if status := statusCode(t, resp); status != http.StatusOK || resp.Body != "fresh" {
+			t.Errorf("request %s after the stalled one answered %d %q, want 200 fresh", id, status, resp.Body)
+		}
+	}
+}
+
+func TestStreamedResponsesNotCoalesced(t *testing.T) {
+	const requests = 5
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+
+		// no Content-Length, the response is streamed
+		io.WriteString(w, "chunk ")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "end")
+	}))
+
+	config := testConfig()
+	config.CoalesceRequests = true
+	config.StreamResponses = true
+
+	conn, fc := newTestTunnel(t, config, port)
+
+	for i := 0; i < requests; i++ {
+		msg := TunnelMessage{Type: TunnelRequest, ID: fmt.Sprint(i), Method: http.MethodGet, Path: "/events"}
+		if err := fc.send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, func() bool { return len(conn.InFlight()) == requests })
+	close(release)
+
+	for id, resp := range fc.responses(requests) {
+		if status := statusCode(t, resp); status != http.StatusOK || resp.Body != "chunk end" || resp.Headers[HeaderTunnelStreamed] == "" {
+			t.Errorf("request %s answered %d %q, want the whole streamed body", id, status, resp.Body)
+		}
+	}
+
+	if n := calls.Load(); n != requests {
+		t.Errorf("backend called %d times, want once per streamed request", n)
+	}
+}
@@ -0,0 +1,81 @@
+package sdk
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// acceptsGzip reports whether an Accept-Encoding value allows gzip.
+func acceptsGzip(acceptEncoding string) bool {
+	for _, encoding := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), "gzip") && strings.TrimSpace(name) != "*" {
+			continue
+		}
+
+		// gzip;q=0 explicitly refuses the encoding
+		if q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok {
+			if value, err := strconv.ParseFloat(q, 64); err == nil && value == 0 {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// compressResponse gzips body in place of the backend's identity encoding
+// and updates the headers to match.
+func compressResponse(header http.Header, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(body); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	header.Set("Content-Encoding", "gzip")
+	header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	header.Add("Vary", "Accept-Encoding")
+
+	return buf.Bytes(), nil
+}
+
+// errDecompressedTooLarge is returned when a gzip body inflates past the
+// configured limit, guarding against decompression bombs.
+var errDecompressedTooLarge = errors.New("decompressed body exceeds the size limit")
+
+// decompressResponse inflates a gzip body for clients that can't decode it
+// and updates the headers to match.
+func decompressResponse(header http.Header, body []byte, limit int64) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > limit {
+		return nil, errDecompressedTooLarge
+	}
+
+	header.Del("Content-Encoding")
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+
+	return data, nil
+}
@@ -0,0 +1,123 @@
+package sdk
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLargeTextResponseCompressed(t *testing.T) {
+	page := strings.Repeat("<p>hello tunnel</p>\n", 1000)
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, page)
+	}))
+
+	config := testConfig()
+	config.CompressResponses = true
+
+	_, fc := newTestTunnel(t, config, port)
+
+	resp := fc.request(TunnelMessage{
+		ID:      "1",
+		Method:  http.MethodGet,
+		Path:    "/",
+		Headers: map[string]string{"Accept-Encoding": "br, gzip"},
+	})
+
+	if encoding := resp.Headers["Content-Encoding"]; encoding != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", encoding)
+	}
+
+	if len(resp.Body) >= len(page) {
+		t.Errorf("compressed body is %d bytes, the page %d", len(resp.Body), len(page))
+	}
+
+	reader, err := gzip.NewReader(strings.NewReader(resp.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(body) != page {
+		t.Error("decompressed body differs from the page")
+	}
+
+	// a client without gzip gets the page as is
+	resp = fc.request(TunnelMessage{ID: "2", Method: http.MethodGet, Path: "/"})
+	if resp.Headers["Content-Encoding"] != "" || resp.Body != page {
+		t.Errorf("response without Accept-Encoding was encoded %q", resp.Headers["Content-Encoding"])
+	}
+}
+
+func TestGzipOnlyBackendDecompressedForPlainClients(t *testing.T) {
+	page := strings.Repeat("<p>hello tunnel</p>\n", 1000)
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// always gzip, whatever the client accepts
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "gzip")
+
+		writer := gzip.NewWriter(w)
+		io.WriteString(writer, page)
+		writer.Close()
+	}))
+
+	config := testConfig()
+	config.DecompressResponses = true
+
+	_, fc := newTestTunnel(t, config, port)
+
+	// without Accept-Encoding net/http negotiates gzip itself, an explicit
+	// list without gzip reaches the backend as is
+	for i, acceptEncoding := range []string{"", "br"} {
+		resp := fc.request(TunnelMessage{ID: fmt.Sprint(i), Method: http.MethodGet, Path: "/", Headers: map[string]string{"Accept-Encoding": acceptEncoding}})
+		if encoding := resp.Headers["Content-Encoding"]; encoding != "" {
+			t.Errorf("Content-Encoding = %q for a client accepting %q", encoding, acceptEncoding)
+		}
+
+		if resp.Body != page {
+			t.Errorf("client accepting %q got a %d byte body, want the %d byte page", acceptEncoding, len(resp.Body), len(page))
+		}
+
+		if length := resp.Headers["Content-Length"]; length != "" && length != strconv.Itoa(len(page)) {
+			t.Errorf("Content-Length = %s, want %d", length, len(page))
+		}
+	}
+
+	// a client accepting gzip gets the backend's encoding
+	resp := fc.request(TunnelMessage{ID: "gzip", Method: http.MethodGet, Path: "/", Headers: map[string]string{"Accept-Encoding": "gzip"}})
+	if encoding := resp.Headers["Content-Encoding"]; encoding != "gzip" {
+		t.Errorf("Content-Encoding = %q for a gzip client, want gzip", encoding)
+	}
+}
+
+func TestDecompressionBombRejected(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(make([]byte, 1<<20))
+	writer.Close()
+
+	header := http.Header{"Content-Encoding": {"gzip"}}
+	if _, err := decompressResponse(header, compressed.Bytes(), 64*1024); !errors.Is(err, errDecompressedTooLarge) {
+		t.Errorf("decompressing 1MiB with a 64KiB limit = %v, want errDecompressedTooLarge", err)
+	}
+
+	body, err := decompressResponse(header, compressed.Bytes(), 1<<20)
+	if err != nil || len(body) != 1<<20 {
+		t.Errorf("decompressing 1MiB with a 1MiB limit = %d bytes, %v", len(body), err)
+	}
+
+	if header.Get("Content-Encoding") != "" || header.Get("Content-Length") != strconv.Itoa(1<<20) {
+		t.Errorf("headers after decompression = %v", header)
+	}
+}
@@ -1,19 +1,308 @@
 package sdk
 
 import (
+	"maps"
+	"net/http"
+	"slices"
 	"time"
 )
 
 type TunnelConfig struct {
 	LocalPort string
 
-	AuthTimeout     time.Duration
+	// LocalHost is the host name or IP address of the local service, for
+	// instance a container on the local network. Empty uses
+	// DefaultLocalHost.
+	LocalHost string
+
+	// LocalScheme is "http" or "https", empty means "http". With
+	// InsecureSkipVerify the certificate of an https local service isn't
+	// verified, which self-signed development certificates require. It
+	// doesn't apply to a custom HTTPClient.
+	LocalScheme        string
+	InsecureSkipVerify bool
+
+	// PortMap routes requests by the public port they arrived on, as
+	// reported in X-Forwarded-Port, to a local port. Unmapped ports use
+	// LocalPort.
+	PortMap map[string]string
+
+	// Backends spreads requests over several local instances by weighted
+	// round-robin instead of LocalPort. Backends failing to answer are
+	// skipped for a short while.
+	Backends []WeightedBackend
+
+	// LocalHandler serves requests in-process instead of forwarding them
+	// to LocalPort over TCP.
+	LocalHandler http.Handler `json:"-"`
+
+	// RequestEditor may modify each request right before it is sent to the
+	// local service. Returning an error answers the request with 400.
+	RequestEditor func(req *http.Request) error `json:"-"`
+
+	// RequestInterceptors run in order after RequestEditor and may return a
+	// different request to forward. ResponseInterceptors run in order on the
+	// local response before its body is read, and may replace the body. An
+	// error from either answers the request with 500.
+	RequestInterceptors  []func(req *http.Request) (*http.Request, error) `json:"-"`
+	ResponseInterceptors []func(resp *http.Response) error                `json:"-"`
+
+	// HTTPClient forwards requests to the local service. It is shared by all
+	// requests of the tunnel, nil uses a client with keep-alives enabled
+	// that waits RequestTimeout at most for the response headers.
+	HTTPClient *http.Client `json:"-"`
+
+	// ResponseTransformers rewrite local responses by media type, such as
+	// "application/json", as found in their Content-Type. A transformer gets
+	// the uncompressed body and the headers, which it may modify, and
+	// returns the body to send. Streamed responses aren't transformed.
+	ResponseTransformers map[string]func(body []byte, headers map[string]string) []byte `json:"-"`
+
+	// PrewarmConnections is how many TCP connections to the local service
+	// are dialed by Start before connecting the tunnel. No request is sent
+	// on them until they're used for forwarded ones. It doesn't apply to a
+	// custom HTTPClient.
+	PrewarmConnections int
+
+	AuthTimeout time.Duration
+
+	// RequestTimeout and ResponseTimeout bound a forwarded request, the
+	// shorter one applying. Once a response is streamed neither does.
 	RequestTimeout  time.Duration
 	ResponseTimeout time.Duration
+
+	// LocalDialTimeout bounds connecting to the local service, so a service
+	// that is down fails fast while RequestTimeout still allows slow
+	// responses. Zero leaves only RequestTimeout. It doesn't apply to a
+	// custom HTTPClient.
+	LocalDialTimeout time.Duration
+
+	// ReadBufferSize is the size of the buffer wrapping the tunnel connection
+	// before decoding messages. Zero uses DefaultReadBufferSize.
+	ReadBufferSize int
+
+	// PausedRetryAfter is advertised in the Retry-After header of the 503
+	// responses sent while request forwarding is paused.
+	PausedRetryAfter time.Duration
+
+	// ForwardEarlyHints relays 103 Early Hints from the local service as a
+	// TunnelEarlyHints message ahead of the final response.
+	ForwardEarlyHints bool
+
+	// CompressResponses gzips uncompressed response bodies of at least
+	// CompressMinBytes when the public client accepts gzip.
+	CompressResponses bool
+	CompressMinBytes  int
+
+	// SessionByteQuota caps the request and response body bytes forwarded
+	// over the tunnel's lifetime. Zero means no quota.
+	SessionByteQuota int64
+
+	// RequestLogPath enables a JSON-lines request log at this path, rotated
+	// to RequestLogPath.1 past RequestLogMaxSize bytes.
+	RequestLogPath    string
+	RequestLogMaxSize int64
+
+	// AllowMethodOverride forwards requests with the method named in the
+	// X-HTTP-Method-Override header, for form-based apps.
+	AllowMethodOverride bool
+
+	// StripConnectionClose drops "Connection: close" from forwarded
+	// requests and from local responses, so connections to the local
+	// service are kept alive and the public client's isn't torn down.
+	StripConnectionClose bool
+
+	// ProbeLocalOnStart makes Start fail with ErrLocalBackendUnavailable
+	// when nothing is listening on LocalPort. The probe gives up after
+	// LocalProbeTimeout, independently of RequestTimeout.
+	ProbeLocalOnStart bool
+	LocalProbeTimeout time.Duration
+
+	// MaxResponseHeaderBytes drops any local response header whose name and
+	// value together exceed this size. Zero disables the limit.
+	MaxResponseHeaderBytes int
+
+	// PullRequests hands incoming requests to NextRequest instead of
+	// forwarding them to the local service.
+	PullRequests bool
+
+	// JSONErrors makes SDK-generated error responses JSON bodies of the form
+	// {"error": {"code": ..., "message": ...}} instead of plain text.
+	JSONErrors bool
+
+	// RewriteLocation rewrites Location headers pointing at the local
+	// service, such as trailing-slash redirects, to the public tunnel URL.
+	// Redirects are then passed to the public client instead of being
+	// followed by the default local client.
+	RewriteLocation bool
+
+	// HostOverride, when set, is sent as the Host of every forwarded
+	// request regardless of the incoming headers.
+	HostOverride string
+
+	// ArtificialDelay holds every forwarded response for this long before
+	// sending it, to simulate a slow tunnel when testing consumers.
+	ArtificialDelay time.Duration
+
+	// ReadOnly only forwards GET, HEAD and OPTIONS requests and answers
+	// every other method with 405.
+	ReadOnly bool
+
+	// StripPathPrefix is removed from the start of request paths and
+	// AddPathPrefix prepended to them, for local services mounted under a
+	// base path: with AddPathPrefix "/myapp", "/foo" is forwarded as
+	// "/myapp/foo".
+	StripPathPrefix string
+	AddPathPrefix   string
+
+	// MaskStatusCodes lists local response statuses replaced by a generic
+	// page before reaching the public client: MaskedBody (served as HTML)
+	// with MaskedStatusCode, 503 by default.
+	MaskStatusCodes  []int
+	MaskedStatusCode int
+	MaskedBody       string
+
+	// DecompressResponses inflates gzip responses for public clients that
+	// don't accept gzip, refusing bodies that inflate past
+	// MaxDecompressedBytes.
+	DecompressResponses  bool
+	MaxDecompressedBytes int64
+
+	// FixContentLength replaces a Content-Length from the local service that
+	// doesn't match the body actually read, reporting the mismatch. A body
+	// ending before its Content-Length is then forwarded rather than failed.
+	FixContentLength bool
+
+	// PartialResponsePolicy handles the local service failing mid-body.
+	PartialResponsePolicy PartialResponsePolicy
+
+	// MaxConcurrentRequests caps the requests forwarded to the local service
+	// at once, 0 means no limit. OverflowPolicy handles the ones over it.
+	MaxConcurrentRequests int
+	OverflowPolicy        OverflowPolicy
+
+	// EarlyRequestPolicy handles requests arriving during the handshake.
+	// Buffered ones waiting longer than EarlyRequestGrace are answered with
+	// 503 instead of forwarded late, 0 forwards them all.
+	EarlyRequestPolicy EarlyRequestPolicy
+	EarlyRequestGrace  time.Duration
+
+	// MaxTotalBufferedBytes caps the request and response bodies held by all
+	// the requests being forwarded together. Requests that would exceed it
+	// are answered with 503. Streamed responses don't count. 0 means no
+	// limit.
+	MaxTotalBufferedBytes int64
+
+	// SessionTokenPath persists the resumption token issued by the server,
+	// which is presented on the next connect to get the same session and
+	// public URL back after a restart.
+	SessionTokenPath string
+
+	// AutoReconnect re-establishes the tunnel after the connection drops
+	// unexpectedly, waiting ReconnectBackoff and doubling the delay after
+	// each failed attempt up to 30s. MaxReconnectAttempts bounds the
+	// attempts per outage, zero meaning no limit.
+	AutoReconnect        bool
+	MaxReconnectAttempts int
+	ReconnectBackoff     time.Duration
+
+	// KeepaliveInterval is how often the tunnel server is pinged, and the
+	// connection is dropped when nothing, a pong or any other message,
+	// arrives within KeepaliveTimeout of a ping.
+	// Zero uses the defaults, a negative interval disables pings.
+	KeepaliveInterval time.Duration
+	KeepaliveTimeout  time.Duration
+
+	// BackoffJitter randomizes reconnect delays, full jitter by default.
+	BackoffJitter BackoffJitter
+
+	// RetryBudget bounds reconnect attempts over time with a token bucket
+	// holding this many attempts, refilled by one every RetryBudgetRefill
+	// (10s when zero). Once it's empty an attempt waits for the next token
+	// whatever the backoff, so a long outage doesn't hammer the server. 0
+	// means no budget.
+	RetryBudget       int
+	RetryBudgetRefill time.Duration
+
+	// PerIPRequestsPerSecond limits the requests of each client IP, taken
+	// from the last X-Forwarded-For hop, the one added by the tunnel server,
+	// answering 429 above it. 0 disables the limit.
+	// PerIPBurst defaults to the rate.
+	PerIPRequestsPerSecond float64
+	PerIPBurst             int
+
+	// CoalesceRequests makes concurrent GET and HEAD requests for the same
+	// path share a single local round trip. Request headers are ignored, so
+	// don't enable it when responses depend on cookies or authorization.
+	// The shared round trip is bounded by the request timeout, and responses
+	// that would be streamed aren't shared.
+	CoalesceRequests bool
+
+	// StreamResponses sends bodies larger than StreamThreshold, or of unknown
+	// length, in TunnelResponseChunk messages instead of buffering them.
+	// Streamed bodies aren't compressed or decompressed.
+	StreamResponses bool
+	StreamThreshold int64
+
+	// MaxStreamDuration cuts a streamed response still running after this
+	// long, ending it with a chunk carrying X-Tunnel-Incomplete. 0 means no
+	// limit.
+	MaxStreamDuration time.Duration
+
+	// BufferSpillThreshold holds at most this many bytes of a buffered
+	// response body in memory, the rest goes to a temporary file in
+	// BufferSpillDir (os.TempDir when empty) removed once the response is
+	// sent. A spilled body is sent from the file in TunnelResponseChunk
+	// messages like a streamed response, unless it's decompressed,
+	// transformed or compressed, which reads it back into memory. 0 keeps
+	// bodies in memory.
+	BufferSpillThreshold int64
+	BufferSpillDir       string
 }
 
+const (
+	DefaultLocalHost = "localhost"
+
+	DefaultReadBufferSize    = 32 * 1024
+	DefaultLocalProbeTimeout = 2 * time.Second
+
+	DefaultMaxDecompressedBytes = 32 * 1024 * 1024
+	DefaultStreamThreshold      = 1024 * 1024
+
+	DefaultKeepaliveInterval = 30 * time.Second
+	DefaultKeepaliveTimeout  = 10 * time.Second
+
+	DefaultReconnectBackoff  = time.Second
+	DefaultRetryBudgetRefill = 10 * time.Second
+	maxReconnectBackoff      = 30 * time.Second
+)
+
 var DefaultTunnelConfig = TunnelConfig{
 	AuthTimeout:     15 * time.Second,
 	RequestTimeout:  20 * time.Second,
 	ResponseTimeout: 20 * time.Second,
+	ReadBufferSize:  DefaultReadBufferSize,
+
+	PausedRetryAfter: 30 * time.Second,
+	CompressMinBytes: 1024,
+
+	LocalProbeTimeout: DefaultLocalProbeTimeout,
+	ReconnectBackoff:  DefaultReconnectBackoff,
+
+	MaxResponseHeaderBytes: 64 * 1024,
+}
+
+// clone returns a copy of c that doesn't share its maps and slices, so a
+// tunnel can adjust its config without affecting the caller's or other
+// tunnels using the same one.
+func (c *TunnelConfig) clone() *TunnelConfig {
+	clone := *c
+	clone.PortMap = maps.Clone(c.PortMap)
+	clone.Backends = slices.Clone(c.Backends)
+	clone.MaskStatusCodes = slices.Clone(c.MaskStatusCodes)
+	clone.ResponseTransformers = maps.Clone(c.ResponseTransformers)
+	clone.RequestInterceptors = slices.Clone(c.RequestInterceptors)
+	clone.ResponseInterceptors = slices.Clone(c.ResponseInterceptors)
+
+	return &clone
 }
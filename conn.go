@@ -1,14 +1,25 @@
 package sdk
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,264 +29,2205 @@ type TunnelConn struct {
 	prodURL  string
 	tunnelID string
 
+	// created is the TunnelCreated message from the last handshake, and
+	// authResponse the last TunnelAuthResponse preceding it
+	created      TunnelMessage
+	authResponse TunnelMessage
+
 	config    *TunnelConfig
 	sdkConfig *SDKConfig
 
-	conn   net.Conn
-	status TunnelStatus
+	// connMu guards link, replaced by every connect and closed by Stop
+	connMu sync.Mutex
+	link   *tunnelLink
+
+	paused  atomic.Bool
+	started atomic.Bool
+
+	// statusMu guards status, updated by Connect, the request loop and Stop,
+	// and the URLs, tunnel ID and handshake messages set by Connect
+	statusMu sync.RWMutex
+	status   TunnelStatus
+
+	// connectedAt is when the tunnel reached StatusConnected, nil while
+	// disconnected
+	connectedAt atomic.Pointer[time.Time]
+
+	// port is the local port, which OnReconnect may change
+	port atomic.Pointer[string]
+
+	client     *http.Client
+	warm       *warmConns
+	stats      tunnelStats
+	errHistory errorHistory
+
+	sessionBytes atomic.Int64
+
+	// inflight maps request IDs to *inflightRequest until they're answered
+	inflight   sync.Map
+	requestLog *requestLogger
+	webhook    *webhookNotifier
+
+	backends    *backendPool
+	ipLimiter   *ipRateLimiter
+	flights     *flightGroup
+	retryBudget *retryBudget
+
+	// ids generates IDs for messages the client originates
+	ids *idGenerator
+
+	// pulled carries requests to NextRequest when PullRequests is set
+	pulled chan TunnelMessage
+
+	reconnectMu       sync.Mutex
+	reconnectAttempts int
+	reconnectErr      error
+	reconnectSince    time.Time
+	retryAfter        time.Duration
+
+	// requests received before TunnelCreated, dispatched once connected
+	earlyRequests []earlyRequest
+
+	// stopCh is closed by Stop, ending the tunnel and any reconnect loop
+	stopCh   chan struct{}
+	stopOnce sync.Once
 
 	errorCh chan error
+	errorMu sync.Mutex
+
+	// handlers tracks the running handleLocalRequests goroutines and
+	// slotWaiters the ones waiting for a slot. draining is set by Shutdown
+	// or Stop to refuse new requests, closing drainCh for the waiting ones.
+	// drainMu orders the Adds with draining so none is added once they wait.
+	handlers    sync.WaitGroup
+	slotWaiters sync.WaitGroup
+	drainMu     sync.Mutex
+	draining    bool
+	drainCh     chan struct{}
+
+	// uploads maps request IDs to the bodies streamed in TunnelStreamData
+	uploads sync.Map
+
+	// awaitingPong is set while a keepalive ping is unanswered. keepaliveMu
+	// orders arming its deadline with readsStalled, the number of upload
+	// frames holding back the read loop, see stallReads
+	awaitingPong atomic.Bool
+	keepaliveMu  sync.Mutex
+	readsStalled int
+
+	// requestSlots holds a token per request being forwarded when
+	// MaxConcurrentRequests is set
+	requestSlots chan struct{}
+
+	// buffers bounds the bytes buffered by all requests when
+	// MaxTotalBufferedBytes is set
+	buffers *bufferBudget
+}
+
+// tunnelLink is one connection to the tunnel server. A reconnect replaces
+// it as a whole, so its fields never mix two connections.
+type tunnelLink struct {
+	conn    net.Conn
+	decoder *json.Decoder
+
+	// writeCh feeds the writer goroutine, the only one encoding to conn.
+	// done is closed once the connection is torn down.
+	writeCh   chan outgoingMessage
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// close tears down the connection and stops the reader and writer
+// goroutines. It is safe to call more than once.
+func (l *tunnelLink) close() {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.conn.Close()
+	})
 }
 
+type inflightRequest struct {
+	method  string
+	path    string
+	start   time.Time
+	bytesIn int
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// InFlightRequest describes a request being forwarded to the local service.
+type InFlightRequest struct {
+	ID      string
+	Method  string
+	Path    string
+	Started time.Time
+}
+
+type outgoingMessage struct {
+	msg   TunnelMessage
+	errCh chan error
+}
+
+// pullQueueSize bounds the requests waiting for NextRequest.
+const pullQueueSize = 64
+
+// maxEarlyRequests bounds the requests held back during the handshake.
+const maxEarlyRequests = 32
+
 func NewTunnelConn(config *TunnelConfig, sdkConfig *SDKConfig, port string) (*TunnelConn, error) {
 	if config == nil {
 		config = &DefaultTunnelConfig
 	}
 
+	// the tunnel sets its own LocalPort, never write to the caller's config
+	config = config.clone()
+
 	if sdkConfig == nil {
 		return nil, errors.New("SDK config is required")
 	}
 
-	config.LocalPort = port
+	if err := validateLocalHost(config.LocalHost); err != nil {
+		return nil, err
+	}
+
+	if config.LocalScheme != "" && config.LocalScheme != "http" && config.LocalScheme != "https" {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidScheme, config.LocalScheme)
+	}
+
+	sdkConfig.initCallbacks()
 
-	fmt.Println(config)
+	config.LocalPort = port
 
-	return &TunnelConn{
+	conn := &TunnelConn{
 		config:    config,
 		sdkConfig: sdkConfig,
-		status:    StatusDisconnected,
-	}, nil
+		ids:       newIDGenerator(sdkConfig.MessageIDPrefix),
+		stopCh:    make(chan struct{}),
+		drainCh:   make(chan struct{}),
+		errorCh:   make(chan error, 1),
+		client:    config.HTTPClient,
+	}
+
+	if conn.client == nil {
+		if config.PrewarmConnections > 0 {
+			conn.warm = &warmConns{}
+		}
+		conn.client = newLocalClient(config, conn.warm)
+	}
+
+	if len(config.Backends) > 0 {
+		conn.backends = newBackendPool(config.Backends)
+	}
+
+	conn.setStatus(StatusDisconnected)
+	conn.port.Store(&config.LocalPort)
+
+	if config.MaxTotalBufferedBytes > 0 {
+		conn.buffers = &bufferBudget{max: config.MaxTotalBufferedBytes}
+	}
+
+	if config.MaxConcurrentRequests > 0 {
+		conn.requestSlots = make(chan struct{}, config.MaxConcurrentRequests)
+	}
+
+	if config.RetryBudget > 0 {
+		conn.retryBudget = newRetryBudget(config.RetryBudget, config.RetryBudgetRefill)
+	}
+
+	if config.CoalesceRequests {
+		conn.flights = newFlightGroup()
+	}
+
+	if config.PerIPRequestsPerSecond > 0 {
+		conn.ipLimiter = newIPRateLimiter(config.PerIPRequestsPerSecond, config.PerIPBurst)
+	}
+
+	if config.PullRequests {
+		conn.pulled = make(chan TunnelMessage, pullQueueSize)
+	}
+
+	if sdkConfig.WebhookURL != "" {
+		conn.webhook = newWebhookNotifier(sdkConfig.WebhookURL)
+	}
+
+	if config.RequestLogPath != "" {
+		requestLog, err := newRequestLogger(config.RequestLogPath, config.RequestLogMaxSize)
+		if err != nil {
+			return nil, err
+		}
+
+		conn.requestLog = requestLog
+	}
+
+	return conn, nil
 }
 
 // Establish a tunnel connection with the server, including authentication
 func (c *TunnelConn) Connect() error {
-	c.status = StatusConnecting
-	c.sdkConfig.OnAuth(c.sdkConfig.AuthToken)
+	return c.ConnectContext(context.Background())
+}
+
+// ConnectContext connects like Connect, aborting the dial and the handshake
+// with ctx.Err() when ctx is cancelled.
+func (c *TunnelConn) ConnectContext(ctx context.Context) error {
+	err := c.connect(ctx)
+	if err != nil && ctx.Err() != nil {
+		c.setStatus(StatusDisconnected)
+		err = ctx.Err()
+	}
+
+	c.recordConnectResult(err)
+
+	return err
+}
+
+// ConnectWithResult connects like Connect and returns the TunnelCreated
+// message sent by the server, including headers the SDK doesn't interpret.
+func (c *TunnelConn) ConnectWithResult() (TunnelMessage, error) {
+	if err := c.Connect(); err != nil {
+		return TunnelMessage{}, err
+	}
+
+	c.statusMu.RLock()
+	defer c.statusMu.RUnlock()
+
+	return c.created, nil
+}
+
+// AuthResponse returns the TunnelAuthResponse the server sent during the
+// last handshake, such as account details. It is zero when none was sent.
+func (c *TunnelConn) AuthResponse() TunnelMessage {
+	c.statusMu.RLock()
+	defer c.statusMu.RUnlock()
+
+	return c.authResponse
+}
 
-	conn, err := net.Dial("tcp", c.sdkConfig.TunnelServer)
+func (c *TunnelConn) connect(ctx context.Context) (err error) {
+	c.setStatus(StatusConnecting)
+	c.earlyRequests = nil
+	c.statusMu.Lock()
+	c.authResponse = TunnelMessage{}
+	c.statusMu.Unlock()
+	c.sdkConfig.currentCallbacks().OnAuth(c.sdkConfig.AuthToken)
+
+	conn, err := c.dial(ctx)
 	if err != nil {
-		c.status = StatusError
-		c.sdkConfig.OnError(err)
+		c.setStatus(StatusError)
+		c.onError(err)
 		return err
 	}
 
-	c.conn = conn
+	bufferSize := c.config.ReadBufferSize
+	if bufferSize <= 0 {
+		bufferSize = DefaultReadBufferSize
+	}
+
+	link := &tunnelLink{
+		conn:    conn,
+		decoder: json.NewDecoder(bufio.NewReaderSize(conn, bufferSize)),
+		writeCh: make(chan outgoingMessage),
+		done:    make(chan struct{}),
+	}
+
+	// Stop closes stopCh before taking connMu, so a link published here is
+	// either seen and closed by Stop or never published at all
+	c.connMu.Lock()
+	if c.isStopping() {
+		c.connMu.Unlock()
+		conn.Close()
+		c.setStatus(StatusDisconnected)
+
+		return ErrConnectionClosed
+	}
+	c.link = link
+	c.connMu.Unlock()
+
+	go c.writeLoop(json.NewEncoder(conn), link.writeCh, link.done)
+
+	// cancelling ctx aborts the handshake by closing the connection
+	stopWatching := context.AfterFunc(ctx, link.close)
+	defer func() {
+		if !stopWatching() && err == nil {
+			link.close()
+			err = ctx.Err()
+		}
+	}()
 
 	// start the authentication process
-	c.status = StatusAuthenticating
-	encoder := json.NewEncoder(conn)
-	decoder := json.NewDecoder(conn)
+	c.setStatus(StatusAuthenticating)
 
-	tunnelMessage := TunnelMessage{
-		Type: TunnelAuthRequest,
-		Body: c.sdkConfig.AuthToken,
+	authenticator := c.sdkConfig.Authenticator
+	if authenticator == nil {
+		authenticator = &TokenAuthenticator{Token: c.sdkConfig.AuthToken}
 	}
 
-	if err := encoder.Encode(tunnelMessage); err != nil {
-		c.status = StatusError
-		c.sdkConfig.OnError(err)
-		conn.Close()
+	if err := c.sendAuthMessage(authenticator); err != nil {
+		c.setStatus(StatusError)
+		c.onError(err)
+		link.close()
 
 		return err
 	}
 
+	var tunnelMessage TunnelMessage
+
 	// set deadline for authentication
 	conn.SetReadDeadline(time.Now().Add(c.config.AuthTimeout))
-	if err := decoder.Decode(&tunnelMessage); err != nil {
-		c.status = StatusError
-		c.sdkConfig.OnError(err)
-		conn.Close()
+	for {
+		tunnelMessage = TunnelMessage{}
+		if err := link.decoder.Decode(&tunnelMessage); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				err = fmt.Errorf("%w: no handshake response within %s", ErrTunnelTimeout, c.config.AuthTimeout)
+			}
 
-		return err
+			c.setStatus(StatusError)
+			c.onError(err)
+			link.close()
+
+			return err
+		}
+
+		if tunnelMessage.Type == TunnelCreated || tunnelMessage.Type == TunnelAuthFailure {
+			break
+		}
+
+		// a racy server may send requests before the tunnel is created,
+		// hold them until the local url is known
+		if tunnelMessage.Type == TunnelRequest {
+			c.bufferEarlyRequest(tunnelMessage)
+			continue
+		}
+
+		// upload frames aren't part of the handshake, nothing can receive
+		// them yet
+		if tunnelMessage.Type == TunnelStreamData {
+			continue
+		}
+
+		if tunnelMessage.Type == TunnelAuthResponse {
+			c.statusMu.Lock()
+			c.authResponse = tunnelMessage
+			c.statusMu.Unlock()
+		}
+
+		err := authenticator.HandleAuthResponse(tunnelMessage)
+		if errors.Is(err, ErrAuthContinue) {
+			err = c.sendAuthMessage(authenticator)
+		}
+
+		if err != nil {
+			c.setStatus(StatusError)
+			c.onError(err)
+			link.close()
+
+			return err
+		}
 	}
 
 	// unset deadline
 	conn.SetReadDeadline(time.Time{})
 
 	if tunnelMessage.Type == TunnelAuthFailure {
-		c.status = StatusError
-		c.sdkConfig.OnError(err)
-		conn.Close()
+		c.recordRetryAfter(tunnelMessage.Headers)
+
+		err := ErrAuthFailure
+		if tunnelMessage.Body != "" {
+			err = fmt.Errorf("%w: %s", ErrAuthFailure, tunnelMessage.Body)
+		}
+
+		c.setStatus(StatusError)
+		c.onError(err)
+		link.close()
 
 		return err
 	}
 
-	c.status = StatusEstablishing
+	c.setStatus(StatusEstablishing)
 
 	if tunnelMessage.Type != TunnelCreated {
-		c.status = StatusError
-		c.sdkConfig.OnError(err)
-		conn.Close()
+		err := fmt.Errorf("expected tunnel created message, got %d", tunnelMessage.Type)
+
+		c.setStatus(StatusError)
+		c.onError(err)
+		link.close()
 
-		return fmt.Errorf("expected tunnel created message, got %d", tunnelMessage.Type)
+		return err
 	}
 
-	c.localURL = tunnelMessage.Headers[HeaderLocalUrl]
-	c.prodURL = tunnelMessage.Headers[HeaderProdUrl]
-	c.tunnelID = tunnelMessage.ID
+	if err := checkProtocolVersion(tunnelMessage.Headers[HeaderProtocolVersion]); err != nil {
+		c.setStatus(StatusError)
+		c.onError(err)
+		link.close()
 
-	c.status = StatusConnected
-	c.sdkConfig.OnConnected(c.config.LocalPort, c.localURL, c.prodURL, c.tunnelID)
+		return err
+	}
 
-	return nil
-}
+	if err := validateTunnelURLs(tunnelMessage.Headers); err != nil {
+		c.setStatus(StatusError)
+		c.onError(err)
+		link.close()
 
-func (c *TunnelConn) Start() error {
-	if err := c.Connect(); err != nil {
 		return err
 	}
 
-	c.handleTunnelRequests()
+	c.saveResumeToken(tunnelMessage.Headers[HeaderResumeToken])
 
-	// TODO: handle the local test server later
+	c.statusMu.Lock()
+	c.created = tunnelMessage
+	c.localURL = tunnelMessage.Headers[HeaderLocalUrl]
+	c.prodURL = tunnelMessage.Headers[HeaderProdUrl]
+	c.tunnelID = tunnelMessage.ID
+	c.statusMu.Unlock()
+
+	c.setStatus(StatusConnected)
+	now := time.Now()
+	c.connectedAt.Store(&now)
+	c.stats.connected()
+	localURL, prodURL := c.URLs()
+	c.sdkConfig.currentCallbacks().OnConnected(c.LocalPort(), localURL, prodURL, c.TunnelID())
+	c.notify(EventConnected, nil)
 
 	return nil
 }
 
-func (c *TunnelConn) handleTunnelRequests() {
-	decoder := json.NewDecoder(c.conn)
-
-	var msg TunnelMessage
-	for {
-		select {
-		case <-c.errorCh:
-			return
-		default:
-			if err := decoder.Decode(&msg); err != nil {
-				if err == io.EOF || strings.Contains(err.Error(), "use of closed network connection") {
-					err = errors.New("COnnection closed")
-					c.sdkConfig.OnError(err)
-					c.errorCh <- err
-				} else {
-					c.sdkConfig.OnError(errors.New("Error while decoding the message: " + err.Error()))
-				}
-
-				c.status = StatusDisconnected
-				return
-			}
+// validateTunnelURLs checks that a TunnelCreated message carries usable
+// local and production URLs.
+func validateTunnelURLs(headers map[string]string) error {
+	for _, header := range []string{HeaderLocalUrl, HeaderProdUrl} {
+		value := headers[header]
+		if value == "" {
+			return fmt.Errorf("tunnel created without %s header", header)
+		}
 
-			if msg.Type == TunnelRequest {
-				go c.handleLocalRequests(msg)
-			} else {
-				c.sdkConfig.OnError(fmt.Errorf("Unexpected message type: %d", msg.Type))
-			}
+		u, err := url.Parse(value)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("tunnel created with invalid %s %q", header, value)
 		}
 	}
-}
 
-func (c *TunnelConn) handleLocalRequests(msg TunnelMessage) {
-	c.sdkConfig.OnRequest(msg)
+	return nil
+}
 
-	// local target url
-	targetURL := fmt.Sprintf("http://localhost:%s%s", c.config.LocalPort, msg.Path)
-	req, err := http.NewRequest(msg.Method, targetURL, strings.NewReader(msg.Body))
+// sendAuthMessage sends the authenticator's next message, advertising the
+// protocol version the client speaks.
+func (c *TunnelConn) sendAuthMessage(authenticator Authenticator) error {
+	msg, err := authenticator.BuildAuthMessage()
 	if err != nil {
-		c.sdkConfig.OnError(errors.New("Error creating request: " + err.Error()))
-		c.sendErrorResponse(msg.ID, http.StatusInternalServerError, "Error creating request: "+err.Error())
-		return
+		return err
 	}
 
-	for key, value := range msg.Headers {
-		if strings.EqualFold(key, "Host") {
-			continue
+	if onBeforeAuth := c.sdkConfig.currentCallbacks().OnBeforeAuth; onBeforeAuth != nil && msg.Type == TunnelAuthRequest {
+		token, err := onBeforeAuth(msg.Body)
+		if err != nil {
+			return fmt.Errorf("authentication aborted by OnBeforeAuth: %w", err)
 		}
 
-		if strings.EqualFold(key, "X-Forwarded-Host") {
-			req.Host = value
+		msg.Body = token
+	}
 
-			// continue
-		}
+	protocolVersion := c.sdkConfig.ProtocolVersion
+	if protocolVersion == 0 {
+		protocolVersion = ProtocolVersion
+	}
 
-		req.Header.Set(key, value)
+	if msg.Headers == nil {
+		msg.Headers = make(map[string]string, 1)
 	}
 
-	if req.Host == "" {
-		req.Host = "localhost:" + c.config.LocalPort
+	msg.Headers[HeaderProtocolVersion] = strconv.Itoa(protocolVersion)
+
+	if token := c.loadResumeToken(); token != "" && msg.Type == TunnelAuthRequest {
+		msg.Headers[HeaderResumeToken] = token
 	}
 
-	client := &http.Client{
-		Timeout: c.config.RequestTimeout,
+	return c.send(msg)
+}
+
+// loadResumeToken reads the session resumption token persisted by a
+// previous run, if any.
+func (c *TunnelConn) loadResumeToken() string {
+	if c.config.SessionTokenPath == "" {
+		return ""
 	}
 
-	resp, err := client.Do(req)
+	data, err := os.ReadFile(c.config.SessionTokenPath)
 	if err != nil {
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			c.sdkConfig.OnError(errors.New("Timeout connecting to the local service: " + err.Error()))
-			c.sendErrorResponse(msg.ID, http.StatusGatewayTimeout, "Local service timed out")
-		} else {
-			c.sdkConfig.OnError(errors.New("Error connecting to the local service: " + err.Error()))
-			c.sendErrorResponse(msg.ID, http.StatusBadGateway, "Error connecting to the local service: "+err.Error())
-		}
+		return ""
+	}
+
+	return strings.TrimSpace(string(data))
+}
 
+// saveResumeToken persists the token the server issued for resuming this
+// session after a restart.
+func (c *TunnelConn) saveResumeToken(token string) {
+	if c.config.SessionTokenPath == "" || token == "" {
 		return
 	}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		c.sdkConfig.OnError(errors.New("Error reading the response body: " + err.Error()))
-		c.sendErrorResponse(msg.ID, http.StatusInternalServerError, "Failed to read local response body")
+	if err := os.WriteFile(c.config.SessionTokenPath, []byte(token), 0o600); err != nil {
+		c.onError(errors.New("Error saving the session token: " + err.Error()))
+	}
+}
+
+// checkProtocolVersion validates the version advertised in TunnelCreated.
+// Servers predating the header speak version 1.
+func checkProtocolVersion(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	version, err := strconv.Atoi(value)
+	if err != nil || version < MinProtocolVersion || version > MaxProtocolVersion {
+		return fmt.Errorf("%w: server speaks %q, client supports %d-%d", ErrUnsupportedProtocolVersion, value, MinProtocolVersion, MaxProtocolVersion)
+	}
+
+	return nil
+}
 
+func (c *TunnelConn) recordConnectResult(err error) {
+	c.reconnectMu.Lock()
+	defer c.reconnectMu.Unlock()
+
+	if err == nil {
+		c.reconnectAttempts = 0
+		c.reconnectErr = nil
+		c.reconnectSince = time.Time{}
 		return
 	}
 
-	defer resp.Body.Close()
+	if c.reconnectAttempts == 0 {
+		c.reconnectSince = time.Now()
+	}
 
-	c.sdkConfig.OnSedingResponse(msg, resp, body)
+	c.reconnectAttempts++
+	c.reconnectErr = err
+}
 
-	responseHeaders := make(map[string]string)
-	for key, values := range resp.Header {
-		if len(values) > 0 {
-			responseHeaders[key] = values[0]
-		}
+// ReconnectState reports the number of consecutive failed connection
+// attempts, the error of the latest one and when the failures started.
+// It is reset by a successful connect.
+func (c *TunnelConn) ReconnectState() (attempts int, lastErr error, since time.Time) {
+	c.reconnectMu.Lock()
+	defer c.reconnectMu.Unlock()
+
+	return c.reconnectAttempts, c.reconnectErr, c.reconnectSince
+}
+
+// dial opens the control connection to the tunnel server, negotiating TLS
+// when the SDK config asks for it.
+func (c *TunnelConn) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Control: c.sdkConfig.Control,
 	}
 
-	responseHeaders["X-Status-Code"] = strconv.Itoa(resp.StatusCode)
-	msg = TunnelMessage{ // response the server
-		Type:    TunnelResponse,
-		ID:      msg.ID,
-		Headers: responseHeaders,
-		Body:    string(body),
+	if c.sdkConfig.TLSConfig == nil {
+		return dialer.DialContext(ctx, "tcp", c.sdkConfig.TunnelServer)
 	}
 
-	encoder := json.NewEncoder(c.conn)
-	if err := encoder.Encode(msg); err != nil {
-		c.sdkConfig.OnError(errors.New("Error sending response: " + err.Error()))
+	// the floor only ever raises the one set on TLSConfig
+	tlsConfig := c.sdkConfig.TLSConfig.Clone()
+	floor := c.sdkConfig.MinTLSVersion
+	if floor == 0 {
+		floor = tls.VersionTLS12
 	}
-}
 
-func (c *TunnelConn) sendErrorResponse(requestID string, statusCode int, message string) {
-	if statusCode < 100 || statusCode > 599 {
-		statusCode = http.StatusInternalServerError
+	if floor > tlsConfig.MinVersion {
+		tlsConfig.MinVersion = floor
 	}
 
-	responseMsg := TunnelMessage{
-		Type: TunnelResponse,
-		ID:   requestID,
-		Headers: map[string]string{
-			"X-Status-Code": strconv.Itoa(statusCode),
-			"Content-Type":  "text/plain; charset=utf-8",
-		},
-		Body: fmt.Sprintf("%d %s: %s", statusCode, http.StatusText(statusCode), message),
+	tlsDialer := &tls.Dialer{NetDialer: dialer, Config: tlsConfig}
+	netConn, err := tlsDialer.DialContext(ctx, "tcp", c.sdkConfig.TunnelServer)
+	if err != nil {
+		return nil, err
 	}
 
-	encoder := json.NewEncoder(c.conn)
-	if err := encoder.Encode(responseMsg); err != nil {
-		c.sdkConfig.OnError(errors.New("Error sending error oresponse: " + err.Error()))
+	conn := netConn.(*tls.Conn)
+	if version := conn.ConnectionState().Version; version < tlsConfig.MinVersion {
+		conn.Close()
+		return nil, fmt.Errorf("negotiated TLS version %s is below the minimum %s", tls.VersionName(version), tls.VersionName(tlsConfig.MinVersion))
 	}
+
+	return conn, nil
 }
 
-func (c *TunnelConn) Stop() error {
-	if c.status == StatusDisconnected {
+// ControlTLSState returns the TLS handshake details of the control
+// connection, or nil when it is plaintext or not connected.
+func (c *TunnelConn) ControlTLSState() *tls.ConnectionState {
+	link := c.currentLink()
+	if link == nil {
+		return nil
+	}
+
+	tlsConn, ok := link.conn.(*tls.Conn)
+	if !ok {
 		return nil
 	}
 
-	close(c.errorCh)
+	state := tlsConn.ConnectionState()
+	return &state
+}
+
+func (c *TunnelConn) Start() error {
+	return c.StartContext(context.Background())
+}
+
+// StartContext starts like Start, with ctx bounding the initial connection
+// and any reconnect attempts. Cancelling ctx once the tunnel is up doesn't
+// stop it, use Stop for that.
+func (c *TunnelConn) StartContext(ctx context.Context) error {
+	return c.start(ctx, c.config.ProbeLocalOnStart)
+}
+
+// start runs the tunnel, probing the local service first when probe is set.
+// TunnelClient probes before starting it, so it doesn't probe twice.
+func (c *TunnelConn) start(ctx context.Context, probe bool) error {
+	if !c.started.CompareAndSwap(false, true) {
+		return ErrAlreadyStarted
+	}
+	defer c.started.Store(false)
+
+	if probe {
+		if err := c.probeLocal(); err != nil {
+			c.onError(err)
+			return err
+		}
+	}
+
+	c.prewarm(ctx)
+
+	if err := c.ConnectContext(ctx); err != nil {
+		// with AutoReconnect a failed first connect, a timeout included, is
+		// retried like any later drop
+		if !c.config.AutoReconnect || c.isStopping() || ctx.Err() != nil {
+			return err
+		}
+
+		if err := c.reconnect(ctx); err != nil {
+			return err
+		}
+
+		if c.isStopping() {
+			return nil
+		}
+	}
+
+	for {
+		c.handleTunnelRequests()
+
+		if c.isStopping() || !c.config.AutoReconnect {
+			break
+		}
+
+		if err := c.reconnect(ctx); err != nil {
+			return err
+		}
 
-	if c.conn != nil {
-		c.conn.Close()
+		if c.isStopping() {
+			break
+		}
 	}
 
-	c.status = StatusDisconnected
-	c.sdkConfig.OnDisconnected()
+	// TODO: handle the local test server later
+
 	return nil
 }
+
+// reconnect re-dials and re-authenticates after an unexpected disconnect,
+// backing off exponentially between attempts. It returns nil once connected
+// or when Stop aborts it.
+func (c *TunnelConn) reconnect(ctx context.Context) error {
+	base := c.config.ReconnectBackoff
+	if base <= 0 {
+		base = DefaultReconnectBackoff
+	}
+
+	var (
+		delay   time.Duration
+		lastErr error
+	)
+
+	for attempt := 0; c.config.MaxReconnectAttempts <= 0 || attempt < c.config.MaxReconnectAttempts; attempt++ {
+		c.setStatus(StatusReconnecting)
+		c.notify(EventReconnecting, lastErr)
+
+		delay = backoffDelay(c.config.BackoffJitter, base, maxReconnectBackoff, attempt, delay)
+
+		// the server may ask to wait longer than the backoff, and an
+		// exhausted retry budget holds the attempt until it refills
+		wait := max(delay, c.takeRetryAfter(), c.retryBudget.reserve(time.Now()))
+
+		select {
+		case <-time.After(wait):
+		case <-c.stopCh:
+			return nil
+		case <-ctx.Done():
+			c.setStatus(StatusDisconnected)
+			return ctx.Err()
+		}
+
+		c.applyOnReconnect(attempt + 1)
+
+		if lastErr = c.ConnectContext(ctx); lastErr == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return lastErr
+		}
+	}
+
+	return fmt.Errorf("reconnect failed after %d attempts: %w", c.config.MaxReconnectAttempts, lastErr)
+}
+
+// applyOnReconnect lets OnReconnect move the tunnel to another local port
+// before a reconnect attempt.
+func (c *TunnelConn) applyOnReconnect(attempt int) {
+	onReconnect := c.sdkConfig.currentCallbacks().OnReconnect
+	if onReconnect == nil {
+		return
+	}
+
+	port := onReconnect(attempt, c.LocalPort())
+	if port == "" || port == c.LocalPort() {
+		return
+	}
+
+	if err := validateLocalPort(port); err != nil {
+		c.onError(fmt.Errorf("Ignoring the port returned by OnReconnect: %w", err))
+		return
+	}
+
+	c.port.Store(&port)
+}
+
+// isStopping reports whether Stop has been called.
+func (c *TunnelConn) isStopping() bool {
+	select {
+	case <-c.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// probeLocal checks that something is listening on the local port.
+func (c *TunnelConn) probeLocal() error {
+	if c.config.LocalHandler != nil {
+		return nil
+	}
+
+	timeout := c.config.LocalProbeTimeout
+	if timeout <= 0 {
+		timeout = DefaultLocalProbeTimeout
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(c.localHost(), c.LocalPort()), timeout)
+	if err != nil {
+		return fmt.Errorf("%w on port %s: %v", ErrLocalBackendUnavailable, c.LocalPort(), err)
+	}
+
+	return conn.Close()
+}
+
+type earlyRequest struct {
+	msg      TunnelMessage
+	received time.Time
+}
+
+func (c *TunnelConn) bufferEarlyRequest(msg TunnelMessage) {
+	if c.config.EarlyRequestPolicy == EarlyRequestReject || len(c.earlyRequests) >= maxEarlyRequests {
+		c.sendErrorResponse(msg.ID, http.StatusServiceUnavailable, "Tunnel is not established yet")
+		return
+	}
+
+	c.earlyRequests = append(c.earlyRequests, earlyRequest{msg: msg, received: time.Now()})
+}
+
+func (c *TunnelConn) handleTunnelRequests() {
+	for _, early := range c.earlyRequests {
+		if c.config.EarlyRequestGrace > 0 && time.Since(early.received) > c.config.EarlyRequestGrace {
+			c.sendErrorResponse(early.msg.ID, http.StatusServiceUnavailable, "Tunnel is not established yet")
+			continue
+		}
+
+		c.dispatchRequest(early.msg)
+	}
+
+	c.earlyRequests = nil
+
+	// drop the error left over by a previous connection, if any
+	select {
+	case <-c.errorCh:
+	default:
+	}
+
+	messages := make(chan TunnelMessage)
+	readErr := make(chan error, 1)
+	link := c.currentLink()
+	go c.readLoop(link, messages, readErr)
+	go c.keepalive(link.conn, link.done)
+
+	for {
+		select {
+		case <-c.errorCh:
+			return
+		case <-link.done:
+			return
+		case err := <-readErr:
+			// reading fails once Stop closes the connection, that's expected
+			if c.stopped() {
+				return
+			}
+
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && c.awaitingPong.Load() {
+				err = fmt.Errorf("%w: nothing received within %s of a keepalive ping", ErrTunnelTimeout, c.keepaliveTimeout())
+				c.onError(err)
+			} else if err == io.EOF || strings.Contains(err.Error(), "use of closed network connection") {
+				err = errors.New("COnnection closed")
+				c.onError(err)
+
+				c.signalError(err)
+			} else {
+				c.onError(errors.New("Error while decoding the message: " + err.Error()))
+			}
+
+			c.closeConn()
+
+			// Stop may have torn the tunnel down in the meantime, only the
+			// move away from connected is reported
+			if c.swapStatus(StatusDisconnected) != StatusConnected {
+				return
+			}
+
+			c.connectedAt.Store(nil)
+			c.stats.disconnected(false)
+			c.sdkConfig.currentCallbacks().OnDisconnected()
+			c.notify(EventDisconnected, err)
+			return
+		case msg := <-messages:
+			if c.stopped() {
+				if onMessage := c.sdkConfig.currentCallbacks().OnMessageAfterStop; onMessage != nil {
+					onMessage(msg)
+				}
+
+				return
+			}
+
+			switch msg.Type {
+			case TunnelRequest:
+				c.dispatchRequest(msg)
+			case TunnelRequestCancelled:
+				c.cancelRequest(msg.ID)
+			case TunnelStreamData:
+				c.uploadData(msg, link.done)
+			case TunnelPing:
+				if err := c.send(TunnelMessage{Type: TunnelPong, ID: msg.ID}); err != nil {
+					c.reportSendError("pong", err)
+				}
+			case TunnelPong:
+				// the read loop already cleared the keepalive deadline
+			default:
+				c.onError(fmt.Errorf("Unexpected message type: %d", msg.Type))
+			}
+		}
+	}
+}
+
+// signalError hands err to errorCh unless the tunnel is stopping, in which
+// case the channel is already closed.
+func (c *TunnelConn) signalError(err error) {
+	c.errorMu.Lock()
+	defer c.errorMu.Unlock()
+
+	if c.isStopping() {
+		return
+	}
+
+	select {
+	case c.errorCh <- err:
+	default:
+	}
+}
+
+// stopped reports whether the connection has been torn down.
+func (c *TunnelConn) stopped() bool {
+	link := c.currentLink()
+	if link == nil {
+		return true
+	}
+
+	select {
+	case <-link.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// onError reports err to the OnError callback and keeps it for DebugSnapshot.
+func (c *TunnelConn) onError(err error) {
+	if err != nil {
+		c.errHistory.add(err)
+	}
+
+	c.sdkConfig.currentCallbacks().OnError(err)
+	c.notify(EventError, err)
+}
+
+// reportSendError reports a message that couldn't be sent, unless Stop
+// closed the connection under it.
+func (c *TunnelConn) reportSendError(what string, err error) {
+	if c.isStopping() && errors.Is(err, ErrConnectionClosed) {
+		return
+	}
+
+	c.onError(errors.New("Error sending " + what + ": " + err.Error()))
+}
+
+func (c *TunnelConn) notify(event string, err error) {
+	if c.webhook == nil {
+		return
+	}
+
+	_, prodURL := c.URLs()
+	payload := WebhookEvent{
+		Event:     event,
+		Time:      time.Now(),
+		TunnelID:  c.TunnelID(),
+		LocalPort: c.LocalPort(),
+		ProdURL:   prodURL,
+	}
+
+	if err != nil {
+		payload.Error = err.Error()
+	}
+
+	c.webhook.notify(payload)
+}
+
+// dispatchRequest verifies the request signature when signing is enabled
+// and forwards the request to the local service on its own goroutine.
+func (c *TunnelConn) dispatchRequest(msg TunnelMessage) {
+	msg.Headers = canonicalHeaders(msg.Headers)
+	msg.MultiHeaders = canonicalMultiHeaders(msg.MultiHeaders)
+
+	if c.sdkConfig.SigningSecret != "" && !verifyMessage(c.sdkConfig.SigningSecret, msg) {
+		c.onError(fmt.Errorf("%w: request %s", ErrInvalidSignature, msg.ID))
+		c.sendErrorResponse(msg.ID, http.StatusUnauthorized, "Invalid request signature")
+		return
+	}
+
+	if err := decodeBody(&msg); err != nil {
+		c.onError(fmt.Errorf("Error decoding the body of request %s: %w", msg.ID, err))
+		c.sendErrorResponse(msg.ID, http.StatusBadRequest, "Error decoding the request body")
+		return
+	}
+
+	if c.pulled != nil {
+		if msg.Headers[HeaderTunnelStreamed] != "" {
+			c.sendErrorResponse(msg.ID, http.StatusNotImplemented, "Streamed request bodies can't be pulled")
+			return
+		}
+
+		select {
+		case c.pulled <- msg:
+		default:
+			c.sendErrorResponse(msg.ID, http.StatusServiceUnavailable, "Too many requests waiting to be pulled")
+		}
+
+		return
+	}
+
+	c.drainMu.Lock()
+	if c.draining {
+		c.drainMu.Unlock()
+		c.sendErrorResponse(msg.ID, http.StatusServiceUnavailable, "Tunnel is shutting down")
+		return
+	}
+	c.handlers.Add(1)
+
+	slot := c.tryRequestSlot()
+	if !slot && c.config.OverflowPolicy == OverflowReject {
+		c.drainMu.Unlock()
+		c.handlers.Done()
+		c.sendErrorResponse(msg.ID, http.StatusServiceUnavailable, "Too many concurrent requests")
+		return
+	}
+
+	if !slot {
+		c.slotWaiters.Add(1)
+	}
+	c.drainMu.Unlock()
+
+	body := c.startUpload(msg)
+
+	go func() {
+		defer c.handlers.Done()
+		defer c.finishUpload(msg.ID, body)
+
+		// the wait happens here so the dispatch loop keeps handling pongs,
+		// pings, upload frames and cancellations meanwhile
+		if !slot {
+			acquired := c.waitRequestSlot(msg)
+			c.slotWaiters.Done()
+
+			if !acquired {
+				return
+			}
+		}
+		defer c.releaseRequestSlot()
+
+		c.handleLocalRequests(msg, body)
+	}()
+}
+
+// tryRequestSlot takes one of the MaxConcurrentRequests slots if one is
+// free.
+func (c *TunnelConn) tryRequestSlot() bool {
+	if c.requestSlots == nil {
+		return true
+	}
+
+	select {
+	case c.requestSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitRequestSlot waits for a slot with OverflowBlock. It reports false
+// when the connection closes first, or answers 503 when Shutdown or Stop
+// starts since only the requests already being forwarded are drained.
+func (c *TunnelConn) waitRequestSlot(msg TunnelMessage) bool {
+	link := c.currentLink()
+	if link == nil {
+		return false
+	}
+
+	select {
+	case c.requestSlots <- struct{}{}:
+		return true
+	case <-c.drainCh:
+		c.sendErrorResponse(msg.ID, http.StatusServiceUnavailable, "Tunnel is shutting down")
+		return false
+	case <-link.done:
+		return false
+	}
+}
+
+func (c *TunnelConn) releaseRequestSlot() {
+	if c.requestSlots != nil {
+		<-c.requestSlots
+	}
+}
+
+// InFlight lists the requests currently being forwarded.
+func (c *TunnelConn) InFlight() []InFlightRequest {
+	var requests []InFlightRequest
+	c.inflight.Range(func(key, value any) bool {
+		request := value.(*inflightRequest)
+		requests = append(requests, InFlightRequest{
+			ID:      key.(string),
+			Method:  request.method,
+			Path:    request.path,
+			Started: request.start,
+		})
+
+		return true
+	})
+
+	return requests
+}
+
+// cancelRequest aborts the in-flight request with the given ID after the
+// server reports that its public client disconnected.
+func (c *TunnelConn) cancelRequest(requestID string) {
+	if value, ok := c.inflight.Load(requestID); ok {
+		value.(*inflightRequest).cancel()
+	}
+}
+
+// readLoop is the only goroutine decoding from the connection once the
+// tunnel is established.
+func (c *TunnelConn) readLoop(link *tunnelLink, messages chan<- TunnelMessage, readErr chan<- error) {
+	for {
+		var msg TunnelMessage
+		if err := link.decoder.Decode(&msg); err != nil {
+			readErr <- err
+			return
+		}
+
+		// any message shows the server is alive, not only a pong, which may
+		// be queued behind others
+		c.messageReceived()
+
+		select {
+		case messages <- msg:
+		case <-link.done:
+			return
+		}
+	}
+}
+
+// writeLoop is the only goroutine encoding to the connection.
+func (c *TunnelConn) writeLoop(encoder *json.Encoder, writeCh <-chan outgoingMessage, done <-chan struct{}) {
+	for {
+		select {
+		case out := <-writeCh:
+			out.errCh <- encoder.Encode(out.msg)
+		case <-done:
+			return
+		}
+	}
+}
+
+// currentLink returns the connection set up by the last connect, or nil
+// before the first one.
+func (c *TunnelConn) currentLink() *tunnelLink {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	return c.link
+}
+
+// closeConn tears down the current connection, if any. It is safe to call
+// more than once.
+func (c *TunnelConn) closeConn() {
+	if link := c.currentLink(); link != nil {
+		link.close()
+	}
+}
+
+func (c *TunnelConn) handleLocalRequests(msg TunnelMessage, upload *upload) {
+	start := time.Now()
+	c.stats.requestReceived(len(msg.Body))
+
+	ctx, cancel, stopDeadline := c.requestContext()
+	defer cancel()
+
+	if _, loaded := c.inflight.LoadOrStore(msg.ID, &inflightRequest{
+		method:  msg.Method,
+		path:    msg.Path,
+		start:   start,
+		bytesIn: len(msg.Body),
+		ctx:     ctx,
+		cancel:  cancel,
+	}); loaded {
+		// answering would be ambiguous, the response goes to the first one
+		c.onError(fmt.Errorf("Duplicate request ID %s ignored", msg.ID))
+		return
+	}
+
+	c.sdkConfig.currentCallbacks().OnRequest(msg)
+
+	if c.paused.Load() {
+		retryAfter := int(c.config.PausedRetryAfter / time.Second)
+		c.sendErrorResponseWithHeaders(msg.ID, http.StatusServiceUnavailable, "Request forwarding is paused", map[string]string{
+			"Retry-After": strconv.Itoa(retryAfter),
+		})
+		return
+	}
+
+	if c.ipLimiter != nil {
+		if ip := clientIP(msg.Headers); ip != "" && !c.ipLimiter.allow(ip, time.Now()) {
+			c.sendErrorResponse(msg.ID, http.StatusTooManyRequests, "Too many requests from "+ip)
+			return
+		}
+	}
+
+	if !c.consumeQuota(len(msg.Body)) {
+		c.sendErrorResponse(msg.ID, http.StatusRequestEntityTooLarge, "Session byte quota exceeded")
+		return
+	}
+
+	var buffers *bufferReservation
+	if c.buffers != nil {
+		buffers = &bufferReservation{budget: c.buffers}
+		defer buffers.release()
+
+		if !buffers.reserve(int64(len(msg.Body))) {
+			c.sendErrorResponse(msg.ID, http.StatusServiceUnavailable, "Too much data buffered, try again later")
+			return
+		}
+	}
+
+	// methods are forwarded verbatim so WebDAV and custom verbs reach the
+	// local service unchanged
+	method := msg.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	overridden := false
+	if c.config.AllowMethodOverride {
+		if override := headerValue(msg.Headers, HeaderMethodOverride); override != "" {
+			override = strings.ToUpper(strings.TrimSpace(override))
+			if !knownMethods[override] {
+				c.sendErrorResponse(msg.ID, http.StatusBadRequest, "Unsupported method override: "+override)
+				return
+			}
+
+			method = override
+			overridden = true
+		}
+	}
+
+	if !validMethod(method) {
+		c.onError(errors.New("Invalid request method: " + method))
+		c.sendErrorResponse(msg.ID, http.StatusBadRequest, "Invalid request method: "+method)
+		return
+	}
+
+	if c.config.ReadOnly && method != http.MethodGet && method != http.MethodHead && method != http.MethodOptions {
+		c.sendErrorResponseWithHeaders(msg.ID, http.StatusMethodNotAllowed, "Tunnel is read-only", map[string]string{
+			"Allow": "GET, HEAD, OPTIONS",
+		})
+		return
+	}
+
+	path := msg.Path
+	if path == "" {
+		path = "/"
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		c.sendErrorResponse(msg.ID, http.StatusBadRequest, "Invalid request path: "+path)
+		return
+	}
+
+	path = rewritePath(path, c.config.StripPathPrefix, c.config.AddPathPrefix)
+
+	// local target url
+	localHost, localPort := c.localHost(), c.localPort(msg)
+
+	var backend *backendState
+	if c.backends != nil {
+		backend = c.backends.pick()
+		localHost, localPort = backend.Host, backend.Port
+	}
+
+	targetURL := fmt.Sprintf("%s://%s%s", c.localScheme(), net.JoinHostPort(localHost, localPort), path)
+
+	var requestBody io.Reader = strings.NewReader(msg.Body)
+	if upload != nil {
+		requestBody = upload.r
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, targetURL, requestBody)
+	if err != nil {
+		c.onError(errors.New("Error creating request: " + err.Error()))
+		c.sendErrorResponse(msg.ID, http.StatusInternalServerError, "Error creating request: "+err.Error())
+		return
+	}
+
+	for key, value := range msg.Headers {
+		if strings.EqualFold(key, "Host") {
+			continue
+		}
+
+		// framing is recomputed for the forwarded request below
+		if strings.EqualFold(key, "Content-Length") || strings.EqualFold(key, "Transfer-Encoding") {
+			continue
+		}
+
+		if c.config.StripConnectionClose && isConnectionClose(key, value) {
+			continue
+		}
+
+		if strings.EqualFold(key, "X-Forwarded-Host") {
+			req.Host = forwardedHost(value)
+
+			// continue
+		}
+
+		if values := msg.MultiHeaders[key]; len(values) > 1 {
+			req.Header[textproto.CanonicalMIMEHeaderKey(key)] = append([]string(nil), values...)
+			continue
+		}
+
+		req.Header.Set(key, value)
+	}
+
+	if req.Host == "" {
+		req.Host = net.JoinHostPort(localHost, localPort)
+	}
+
+	if c.config.HostOverride != "" {
+		req.Host = c.config.HostOverride
+	}
+
+	// keep chunked uploads chunked instead of forcing a Content-Length
+	if upload != nil || strings.Contains(strings.ToLower(headerValue(msg.Headers, "Transfer-Encoding")), "chunked") {
+		req.ContentLength = -1
+		req.TransferEncoding = []string{"chunked"}
+	}
+
+	if overridden {
+		req.Header.Del(HeaderMethodOverride)
+	}
+
+	if c.config.RequestEditor != nil {
+		if err := c.config.RequestEditor(req); err != nil {
+			c.sendErrorResponse(msg.ID, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	for _, intercept := range c.config.RequestInterceptors {
+		next, err := intercept(req)
+		if err != nil {
+			c.onError(fmt.Errorf("Request %s rejected by interceptor: %w", msg.ID, err))
+			c.sendErrorResponse(msg.ID, http.StatusInternalServerError, "Request interceptor failed: "+err.Error())
+			return
+		}
+
+		if next != nil {
+			req = next
+		}
+	}
+
+	if c.config.ForwardEarlyHints {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				if code == http.StatusEarlyHints {
+					c.sendEarlyHints(msg.ID, header)
+				}
+
+				return nil
+			},
+		}))
+	}
+
+	var resp *http.Response
+	if c.flights != nil && coalescable(req) {
+		// the URL holds the resolved local host and port, so requests
+		// routed to different services by PortMap or Backends never share
+		resp, err = c.coalescedRoundTrip(req, req.Method+" "+req.URL.String())
+	} else {
+		resp, err = c.roundTrip(req)
+	}
+
+	if err != nil {
+		if requestCancelled(ctx) {
+			// the public client went away, nobody is waiting for a response
+			c.inflight.Delete(msg.ID)
+			return
+		}
+
+		if status, uploadErr := upload.failure(); uploadErr != nil {
+			c.onError(fmt.Errorf("Request %s body upload aborted: %w", msg.ID, uploadErr))
+			c.sendErrorResponse(msg.ID, status, "Request body upload aborted: "+uploadErr.Error())
+			return
+		}
+
+		if backend != nil {
+			c.backends.markFailed(backend)
+		}
+
+		if netErr, ok := err.(net.Error); (ok && netErr.Timeout()) || errors.Is(context.Cause(ctx), context.DeadlineExceeded) {
+			c.onError(errors.New("Timeout connecting to the local service: " + err.Error()))
+			c.sendErrorResponse(msg.ID, http.StatusGatewayTimeout, "Local service timed out")
+		} else {
+			reason := localErrorReason(err)
+			c.onError(errors.New(reason + ": " + err.Error()))
+			c.sendErrorResponse(msg.ID, http.StatusBadGateway, reason+": "+err.Error())
+		}
+
+		return
+	}
+
+	defer resp.Body.Close()
+
+	for _, intercept := range c.config.ResponseInterceptors {
+		if err := intercept(resp); err != nil {
+			c.onError(fmt.Errorf("Response to %s rejected by interceptor: %w", msg.ID, err))
+			c.sendErrorResponse(msg.ID, http.StatusInternalServerError, "Response interceptor failed: "+err.Error())
+			return
+		}
+	}
+
+	if slices.Contains(c.config.MaskStatusCodes, resp.StatusCode) {
+		c.sendMaskedResponse(msg.ID)
+		return
+	}
+
+	if _, prodURL := c.URLs(); c.config.RewriteLocation && prodURL != "" {
+		if location := resp.Header.Get("Location"); location != "" {
+			resp.Header.Set("Location", rewriteLocation(location, localHost, localPort, prodURL))
+		}
+	}
+
+	if c.config.StripConnectionClose && isConnectionClose("Connection", resp.Header.Get("Connection")) {
+		resp.Header.Del("Connection")
+	}
+
+	if c.shouldStream(resp) {
+		// a stream may outlive any timeout, only the wait for the headers
+		// was bounded
+		stopDeadline()
+		c.streamResponse(ctx, msg, resp, start)
+		return
+	}
+
+	var (
+		body    []byte
+		spilled *spilledBody
+	)
+
+	if c.config.BufferSpillThreshold > 0 {
+		body, spilled, err = readBodySpilling(ctx, resp.Body, c.config.BufferSpillThreshold, c.config.BufferSpillDir, buffers)
+		if spilled != nil {
+			defer spilled.Close()
+		}
+	} else {
+		if buffers != nil {
+			resp.Body = &budgetReader{ReadCloser: resp.Body, reservation: buffers}
+		}
+
+		body, err = readBody(ctx, resp.Body)
+	}
+
+	size := int64(len(body))
+	if spilled != nil {
+		size = spilled.size
+	}
+
+	// a body shorter than its Content-Length ends in io.ErrUnexpectedEOF,
+	// which is the mismatch FixContentLength corrects below
+	if c.config.FixContentLength && errors.Is(err, io.ErrUnexpectedEOF) && resp.ContentLength > size {
+		err = nil
+	}
+
+	if err != nil {
+		if requestCancelled(ctx) {
+			c.inflight.Delete(msg.ID)
+			return
+		}
+
+		switch {
+		case errors.Is(err, errBufferLimit):
+			c.onError(fmt.Errorf("Response to %s dropped: %w", msg.ID, err))
+			c.sendErrorResponse(msg.ID, http.StatusServiceUnavailable, "Too much data buffered, try again later")
+
+			return
+		case size == 0 || (ctx.Err() == nil && c.config.PartialResponsePolicy != PartialResponseForward):
+			c.onError(errors.New("Error reading the response body: " + err.Error()))
+			c.sendErrorResponse(msg.ID, http.StatusInternalServerError, "Failed to read local response body")
+
+			return
+		case ctx.Err() == nil:
+			// the local service dropped the connection mid-body
+			c.onError(errors.New("Response body incomplete: " + err.Error()))
+			resp.Header.Set(HeaderTunnelIncomplete, "true")
+			resp.Header.Del("Content-Length")
+		default:
+			// forward what was read before the cancellation, marked as truncated
+			c.onError(errors.New("Response body truncated: " + err.Error()))
+			resp.Header.Set(HeaderTunnelTruncated, "true")
+			resp.Header.Del("Content-Length")
+		}
+	}
+
+	if spilled != nil {
+		if !c.rewritesBody(msg, resp) {
+			// sent from the file in chunks, never held in memory whole
+			resp.Body = spilled
+			c.streamResponse(ctx, msg, resp, start)
+			return
+		}
+
+		// decompressing, transforming or compressing needs it in memory
+		if !buffers.reserve(spilled.size) {
+			c.onError(fmt.Errorf("Response to %s dropped: %w", msg.ID, errBufferLimit))
+			c.sendErrorResponse(msg.ID, http.StatusServiceUnavailable, "Too much data buffered, try again later")
+			return
+		}
+
+		if body, err = io.ReadAll(spilled); err != nil {
+			c.onError(errors.New("Error reading the spilled response body: " + err.Error()))
+			c.sendErrorResponse(msg.ID, http.StatusInternalServerError, "Failed to read local response body")
+			return
+		}
+	}
+
+	if c.config.FixContentLength {
+		if declared := resp.Header.Get("Content-Length"); declared != "" && declared != strconv.Itoa(len(body)) {
+			c.onError(fmt.Errorf("Response to %s declared Content-Length %s but has %d bytes, correcting it", msg.ID, declared, len(body)))
+			resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		}
+	}
+
+	if !c.consumeQuota(len(body)) {
+		c.sendErrorResponse(msg.ID, 509, "Session byte quota exceeded")
+		return
+	}
+
+	if c.shouldDecompress(msg, resp) {
+		limit := c.config.MaxDecompressedBytes
+		if limit <= 0 {
+			limit = DefaultMaxDecompressedBytes
+		}
+
+		decompressed, err := decompressResponse(resp.Header, body, limit)
+		if err != nil {
+			c.onError(errors.New("Error decompressing the response body: " + err.Error()))
+			c.sendErrorResponse(msg.ID, http.StatusBadGateway, "Failed to decompress local response body")
+			return
+		}
+
+		body = decompressed
+	}
+
+	body = c.transformResponse(resp, body)
+
+	if c.shouldCompress(msg, resp, body) {
+		compressed, err := compressResponse(resp.Header, body)
+		if err != nil {
+			c.onError(errors.New("Error compressing the response body: " + err.Error()))
+		} else {
+			body = compressed
+		}
+	}
+
+	c.sdkConfig.currentCallbacks().OnSedingResponse(msg, resp, body)
+
+	responseHeaders, multiHeaders := c.responseHeaders(resp)
+	msg = TunnelMessage{ // response the server
+		Type:         TunnelResponse,
+		ID:           msg.ID,
+		Headers:      responseHeaders,
+		MultiHeaders: multiHeaders,
+		Body:         string(body),
+	}
+
+	if c.config.ArtificialDelay > 0 {
+		select {
+		case <-time.After(c.config.ArtificialDelay):
+		case <-ctx.Done():
+		}
+	}
+
+	if err := c.send(msg); err != nil {
+		c.reportSendError("response", err)
+		return
+	}
+
+	c.stats.responseSent(len(body), time.Since(start))
+}
+
+// responseHeaders flattens the headers of resp for a tunnel response,
+// dropping the ones over MaxResponseHeaderBytes.
+func (c *TunnelConn) responseHeaders(resp *http.Response) (map[string]string, map[string][]string) {
+	responseHeaders := make(map[string]string, len(resp.Header)+1)
+	var multiHeaders map[string][]string
+	for key, values := range resp.Header {
+		if len(values) > 0 {
+			size := len(key)
+			for _, value := range values {
+				size += len(value)
+			}
+
+			if c.config.MaxResponseHeaderBytes > 0 && size > c.config.MaxResponseHeaderBytes {
+				c.onError(fmt.Errorf("Dropping response header %s of %d bytes, over the %d byte limit", key, size-len(key), c.config.MaxResponseHeaderBytes))
+				continue
+			}
+
+			responseHeaders[key] = values[0]
+
+			if len(values) > 1 {
+				if multiHeaders == nil {
+					multiHeaders = make(map[string][]string)
+				}
+
+				multiHeaders[key] = values
+			}
+		}
+	}
+
+	responseHeaders["X-Status-Code"] = strconv.Itoa(resp.StatusCode)
+
+	return responseHeaders, multiHeaders
+}
+
+// consumeQuota accounts n body bytes against SessionByteQuota and reports
+// whether they fit.
+func (c *TunnelConn) consumeQuota(n int) bool {
+	if c.config.SessionByteQuota <= 0 {
+		return true
+	}
+
+	return c.sessionBytes.Add(int64(n)) <= c.config.SessionByteQuota
+}
+
+func (c *TunnelConn) shouldDecompress(msg TunnelMessage, resp *http.Response) bool {
+	if !c.config.DecompressResponses || !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return false
+	}
+
+	return !acceptsGzip(headerValue(msg.Headers, "Accept-Encoding"))
+}
+
+// rewritesBody reports whether the body of resp may be decompressed,
+// transformed or compressed before being sent.
+func (c *TunnelConn) rewritesBody(msg TunnelMessage, resp *http.Response) bool {
+	return c.shouldDecompress(msg, resp) || len(c.config.ResponseTransformers) > 0 || c.config.CompressResponses
+}
+
+func (c *TunnelConn) shouldCompress(msg TunnelMessage, resp *http.Response, body []byte) bool {
+	if !c.config.CompressResponses || len(body) < c.config.CompressMinBytes {
+		return false
+	}
+
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return false
+	}
+
+	return acceptsGzip(headerValue(msg.Headers, "Accept-Encoding"))
+}
+
+func (c *TunnelConn) localHost() string {
+	if c.config.LocalHost == "" {
+		return DefaultLocalHost
+	}
+
+	return c.config.LocalHost
+}
+
+// LocalPort returns the port of the local service requests are forwarded
+// to, unless routed by PortMap or Backends.
+func (c *TunnelConn) LocalPort() string {
+	return *c.port.Load()
+}
+
+// localPort picks the local port for a request, mapping the public port
+// the server received it on through PortMap.
+func (c *TunnelConn) localPort(msg TunnelMessage) string {
+	if len(c.config.PortMap) > 0 {
+		if port, ok := c.config.PortMap[headerValue(msg.Headers, HeaderForwardedPort)]; ok {
+			return port
+		}
+	}
+
+	return c.LocalPort()
+}
+
+// localScheme is the scheme used to reach the local service, http unless
+// LocalScheme says otherwise.
+func (c *TunnelConn) localScheme() string {
+	if c.config.LocalScheme == "" {
+		return "http"
+	}
+
+	return c.config.LocalScheme
+}
+
+// requestContext returns the context of a forwarded request. It is
+// cancelled when the connection is torn down, or with a
+// context.DeadlineExceeded cause once the request timeout elapses, unless
+// stopDeadline was called first.
+func (c *TunnelConn) requestContext() (ctx context.Context, cancel context.CancelFunc, stopDeadline func()) {
+	ctx, cancelCause := context.WithCancelCause(context.Background())
+
+	stopDeadline = func() {}
+	if timeout := c.requestTimeout(); timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			cancelCause(context.DeadlineExceeded)
+		})
+		stopDeadline = func() { timer.Stop() }
+	}
+
+	cancel = func() {
+		stopDeadline()
+		cancelCause(nil)
+	}
+
+	var done <-chan struct{}
+	if link := c.currentLink(); link != nil {
+		done = link.done
+	}
+
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel, stopDeadline
+}
+
+// requestTimeout is the shorter of RequestTimeout and ResponseTimeout, zero
+// when neither is set.
+func (c *TunnelConn) requestTimeout() time.Duration {
+	timeout := c.config.ResponseTimeout
+	if c.config.RequestTimeout > 0 && (timeout <= 0 || c.config.RequestTimeout < timeout) {
+		timeout = c.config.RequestTimeout
+	}
+
+	return timeout
+}
+
+// requestCancelled reports whether the request context was cancelled, as
+// when the public client went away, rather than timed out.
+func requestCancelled(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), context.Canceled)
+}
+
+// localIdleConns is how many idle keep-alive connections to the local
+// service the default client keeps.
+const localIdleConns = 64
+
+// newLocalClient builds the default client used to reach the local service,
+// keeping enough idle connections for concurrent requests to reuse them. It
+// dials through warm, when set, to use the connections pre-dialed there.
+func newLocalClient(config *TunnelConfig, warm *warmConns) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = localIdleConns
+	transport.MaxIdleConnsPerHost = localIdleConns
+
+	if config.LocalDialTimeout > 0 {
+		dialer := &net.Dialer{
+			Timeout:   config.LocalDialTimeout,
+			KeepAlive: 30 * time.Second,
+		}
+
+		transport.DialContext = dialer.DialContext
+	}
+
+	if warm != nil {
+		warm.dial = transport.DialContext
+		transport.DialContext = warm.DialContext
+	}
+
+	if config.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	// only the headers are bounded here, the request context bounds
+	// buffered bodies and streamed ones may take as long as they need
+	transport.ResponseHeaderTimeout = config.RequestTimeout
+
+	client := &http.Client{Transport: transport}
+
+	// with RewriteLocation redirects are the public client's to follow,
+	// otherwise they're followed locally as before
+	if config.RewriteLocation {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+
+	return client
+}
+
+// roundTrip sends the request to the local service, or serves it with the
+// in-process LocalHandler when one is configured.
+func (c *TunnelConn) roundTrip(req *http.Request) (*http.Response, error) {
+	if c.config.LocalHandler == nil {
+		return c.client.Do(req)
+	}
+
+	req.RequestURI = req.URL.RequestURI()
+
+	recorder := httptest.NewRecorder()
+	c.config.LocalHandler.ServeHTTP(recorder, req)
+
+	return recorder.Result(), nil
+}
+
+// send hands a message to the writer goroutine and waits for it to be
+// written, so concurrent request handlers never interleave messages.
+func (c *TunnelConn) send(msg TunnelMessage) error {
+	if msg.Type == TunnelResponse && msg.Headers[HeaderTunnelStreamed] == "" {
+		c.finishRequest(msg.ID, msg.Headers["X-Status-Code"], len(msg.Body))
+	}
+
+	if msg.Type == TunnelResponse || msg.Type == TunnelResponseChunk {
+		encodeBody(&msg)
+	}
+
+	link := c.currentLink()
+	if link == nil {
+		return ErrConnectionClosed
+	}
+
+	out := outgoingMessage{msg: msg, errCh: make(chan error, 1)}
+
+	select {
+	case link.writeCh <- out:
+	case <-link.done:
+		return ErrConnectionClosed
+	}
+
+	select {
+	case err := <-out.errCh:
+		return err
+	case <-link.done:
+		return ErrConnectionClosed
+	}
+}
+
+// knownMethods are the methods accepted in X-HTTP-Method-Override.
+var knownMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// validMethod reports whether method is a valid HTTP token (RFC 7230).
+// Any token is accepted, not only the methods known to net/http.
+func validMethod(method string) bool {
+	if method == "" {
+		return false
+	}
+
+	for _, r := range method {
+		if r >= 0x7f || r <= ' ' || strings.ContainsRune("()<>@,;:\\\"/[]?={}", r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// finishRequest drops an answered request from the in-flight map and
+// records it in the request log.
+func (c *TunnelConn) finishRequest(requestID, status string, bytesOut int) {
+	value, ok := c.inflight.LoadAndDelete(requestID)
+	if !ok {
+		return
+	}
+
+	request := value.(*inflightRequest)
+	c.requestLog.log(requestLogEntry{
+		Time:     request.start,
+		ID:       requestID,
+		Method:   request.method,
+		Path:     request.path,
+		Status:   status,
+		Duration: time.Since(request.start).String(),
+		BytesIn:  request.bytesIn,
+		BytesOut: bytesOut,
+	})
+}
+
+// sendMaskedResponse answers with the generic page configured to hide a
+// local response whose status is listed in MaskStatusCodes.
+func (c *TunnelConn) sendMaskedResponse(requestID string) {
+	statusCode := c.config.MaskedStatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusServiceUnavailable
+	}
+
+	if c.config.MaskedBody == "" {
+		c.sendErrorResponse(requestID, statusCode, "Service temporarily unavailable")
+		return
+	}
+
+	c.sendResponse(requestID, Response{
+		StatusCode: statusCode,
+		Headers:    map[string]string{"Content-Type": "text/html; charset=utf-8"},
+		Body:       c.config.MaskedBody,
+	})
+}
+
+// rewriteLocation points a redirect at the local service to the public
+// tunnel URL instead. Relative and unrelated locations are left untouched.
+func rewriteLocation(location, localHost, localPort, publicURL string) string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if !slices.Contains(hosts, localHost) {
+		hosts = append(hosts, localHost)
+	}
+
+	for _, host := range hosts {
+		for _, scheme := range []string{"http://", "https://"} {
+			base := scheme + net.JoinHostPort(host, localPort)
+			if rest, ok := strings.CutPrefix(location, base); ok && (rest == "" || strings.HasPrefix(rest, "/") || strings.HasPrefix(rest, "?")) {
+				return strings.TrimSuffix(publicURL, "/") + rest
+			}
+		}
+	}
+
+	return location
+}
+
+func isConnectionClose(key, value string) bool {
+	return strings.EqualFold(key, "Connection") && strings.EqualFold(strings.TrimSpace(value), "close")
+}
+
+// forwardedHost returns the original host from an X-Forwarded-Host value.
+// Proxy chains append to the list, so the first entry is the client-facing one.
+func forwardedHost(value string) string {
+	for _, host := range strings.Split(value, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			return host
+		}
+	}
+
+	return ""
+}
+
+func (c *TunnelConn) sendEarlyHints(requestID string, header textproto.MIMEHeader) {
+	headers := make(map[string]string, len(header)+1)
+	for key, values := range header {
+		headers[key] = strings.Join(values, ", ")
+	}
+
+	headers["X-Status-Code"] = strconv.Itoa(http.StatusEarlyHints)
+
+	if err := c.send(TunnelMessage{Type: TunnelEarlyHints, ID: requestID, Headers: headers}); err != nil {
+		c.reportSendError("early hints", err)
+	}
+}
+
+func (c *TunnelConn) sendErrorResponse(requestID string, statusCode int, message string) {
+	c.sendErrorResponseWithHeaders(requestID, statusCode, message, nil)
+}
+
+// jsonError is the error body sent when TunnelConfig.JSONErrors is set.
+type jsonError struct {
+	Error jsonErrorDetail `json:"error"`
+}
+
+type jsonErrorDetail struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (c *TunnelConn) sendErrorResponseWithHeaders(requestID string, statusCode int, message string, headers map[string]string) {
+	c.stats.errorSent()
+
+	if statusCode < 100 || statusCode > 599 {
+		statusCode = http.StatusInternalServerError
+	}
+
+	responseMsg := TunnelMessage{
+		Type: TunnelResponse,
+		ID:   requestID,
+		Headers: map[string]string{
+			"X-Status-Code": strconv.Itoa(statusCode),
+			"Content-Type":  "text/plain; charset=utf-8",
+		},
+		Body: fmt.Sprintf("%d %s: %s", statusCode, http.StatusText(statusCode), message),
+	}
+
+	if c.config.JSONErrors {
+		body, err := json.Marshal(jsonError{Error: jsonErrorDetail{Code: statusCode, Message: message}})
+		if err == nil {
+			responseMsg.Headers["Content-Type"] = "application/json"
+			responseMsg.Body = string(body)
+		}
+	}
+
+	for key, value := range headers {
+		responseMsg.Headers[textproto.CanonicalMIMEHeaderKey(key)] = value
+	}
+
+	if err := c.send(responseMsg); err != nil {
+		c.reportSendError("error oresponse", err)
+	}
+}
+
+// Pause stops forwarding requests to the local service without closing the
+// tunnel. Requests received while paused are answered with 503.
+func (c *TunnelConn) Pause() {
+	c.paused.Store(true)
+}
+
+// Resume restarts forwarding requests to the local service after Pause.
+func (c *TunnelConn) Resume() {
+	c.paused.Store(false)
+}
+
+// Paused reports whether request forwarding is currently paused.
+func (c *TunnelConn) Paused() bool {
+	return c.paused.Load()
+}
+
+// Status returns the current state of the tunnel connection.
+func (c *TunnelConn) Status() TunnelStatus {
+	c.statusMu.RLock()
+	defer c.statusMu.RUnlock()
+
+	return c.status
+}
+
+// URLs returns the local and production URLs of the tunnel, empty until
+// it is first connected.
+func (c *TunnelConn) URLs() (localURL, prodURL string) {
+	c.statusMu.RLock()
+	defer c.statusMu.RUnlock()
+
+	return c.localURL, c.prodURL
+}
+
+// TunnelID returns the ID the server assigned to the tunnel.
+func (c *TunnelConn) TunnelID() string {
+	c.statusMu.RLock()
+	defer c.statusMu.RUnlock()
+
+	return c.tunnelID
+}
+
+func (c *TunnelConn) setStatus(status TunnelStatus) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+
+	c.status = status
+}
+
+// swapStatus sets the status and returns the previous one, so only one of
+// several racing callers sees the transition.
+func (c *TunnelConn) swapStatus(status TunnelStatus) TunnelStatus {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+
+	previous := c.status
+	c.status = status
+
+	return previous
+}
+
+// ConnectedAt returns when the current connection was established, or the
+// zero time while disconnected.
+func (c *TunnelConn) ConnectedAt() time.Time {
+	if at := c.connectedAt.Load(); at != nil {
+		return *at
+	}
+
+	return time.Time{}
+}
+
+// Uptime returns how long the current connection has been up.
+func (c *TunnelConn) Uptime() time.Duration {
+	connectedAt := c.ConnectedAt()
+	if connectedAt.IsZero() {
+		return 0
+	}
+
+	return time.Since(connectedAt)
+}
+
+// Stats returns a snapshot of the traffic forwarded through the tunnel.
+func (c *TunnelConn) Stats() Stats {
+	return c.stats.snapshot()
+}
+
+// ResetStats zeroes the traffic counters without affecting the connection.
+func (c *TunnelConn) ResetStats() {
+	c.stats.reset()
+}
+
+// Shutdown stops the tunnel gracefully: new requests and the ones waiting
+// for a MaxConcurrentRequests slot are refused with 503 while the ones being
+// forwarded complete, then the tunnel is stopped. If ctx is done first the
+// tunnel is stopped right away and ctx.Err() returned.
+func (c *TunnelConn) Shutdown(ctx context.Context) error {
+	c.startDraining()
+
+	drained := make(chan struct{})
+	go func() {
+		c.handlers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return c.Stop()
+	case <-ctx.Done():
+		c.Stop()
+		return ctx.Err()
+	}
+}
+
+// stopAnswerTimeout bounds how long Stop waits for the 503s of the requests
+// waiting for a slot.
+const stopAnswerTimeout = time.Second
+
+// startDraining refuses new requests and answers the ones waiting for a
+// slot with 503.
+func (c *TunnelConn) startDraining() {
+	c.drainMu.Lock()
+	defer c.drainMu.Unlock()
+
+	if !c.draining {
+		c.draining = true
+		close(c.drainCh)
+	}
+}
+
+// answerSlotWaiters drains the tunnel and waits, at most stopAnswerTimeout
+// in case the connection is stuck, for the requests waiting for a slot to
+// be answered before the connection goes.
+func (c *TunnelConn) answerSlotWaiters() {
+	c.startDraining()
+
+	answered := make(chan struct{})
+	go func() {
+		c.slotWaiters.Wait()
+		close(answered)
+	}()
+
+	select {
+	case <-answered:
+	case <-time.After(stopAnswerTimeout):
+	}
+}
+
+func (c *TunnelConn) Stop() error {
+	// the teardown and the report run once, even when the tunnel already
+	// dropped and a reconnect is pending or was never attempted
+	c.stopOnce.Do(func() {
+		c.answerSlotWaiters()
+
+		c.errorMu.Lock()
+		close(c.stopCh)
+		close(c.errorCh)
+		c.errorMu.Unlock()
+
+		c.closeConn()
+		c.requestLog.Close()
+
+		if c.warm != nil {
+			c.warm.close()
+		}
+
+		report := ShutdownReport{
+			TunnelID:  c.TunnelID(),
+			LocalPort: c.LocalPort(),
+			Uptime:    c.Uptime(),
+		}
+
+		// only a connected tunnel is reported, a drop reported its own
+		// disconnect and a tunnel reconnecting or never connected has none
+		if c.swapStatus(StatusDisconnected) == StatusConnected {
+			c.connectedAt.Store(nil)
+			c.stats.disconnected(true)
+			c.sdkConfig.currentCallbacks().OnDisconnected()
+			c.notify(EventDisconnected, nil)
+		}
+
+		report.Stats = c.stats.snapshot()
+		c.reportShutdown(report)
+	})
+
+	return nil
+}
+
+func (c *TunnelConn) reportShutdown(report ShutdownReport) {
+	if c.sdkConfig.Logger != nil {
+		c.sdkConfig.Logger.Print(report)
+	}
+
+	if onShutdown := c.sdkConfig.currentCallbacks().OnShutdown; onShutdown != nil {
+		onShutdown(report)
+	}
+}
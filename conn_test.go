@@ -0,0 +1,2685 @@
+package sdk
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testTimeout bounds every wait of the tests on the tunnel.
+const testTimeout = 5 * time.Second
+
+// fakeServer is a tunnel server listening on a loopback port. Every client
+// connecting goes through handshake and is then handed out by accept.
+type fakeServer struct {
+	t         testing.TB
+	listener  net.Listener
+	conns     chan *fakeConn
+	handshake func(fc *fakeConn) error
+}
+
+// fakeConn is the server side of one client connection.
+type fakeConn struct {
+	t       testing.TB
+	conn    net.Conn
+	decoder *json.Decoder
+
+	encoderMu sync.Mutex
+	encoder   *json.Encoder
+
+	// auth is the TunnelAuthRequest the client sent
+	auth TunnelMessage
+}
+
+// newFakeServer starts a server creating a tunnel for every client.
+func newFakeServer(t testing.TB) *fakeServer {
+	return newFakeServerWith(t, acceptTunnel)
+}
+
+// newFakeServerWith starts a server running handshake on every client, the
+// connection is dropped when it fails.
+func newFakeServerWith(t testing.TB, handshake func(fc *fakeConn) error) *fakeServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return serveFakeServer(t, listener, handshake)
+}
+
+// newTLSFakeServer starts a server creating tunnels over TLS with config,
+// using the certificate of httptest when config has none.
+func newTLSFakeServer(t testing.TB, config *tls.Config) *fakeServer {
+	t.Helper()
+
+	if len(config.Certificates) == 0 {
+		backend := httptest.NewTLSServer(http.NotFoundHandler())
+		config.Certificates = backend.TLS.Certificates
+		backend.Close()
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return serveFakeServer(t, listener, acceptTunnel)
+}
+
+func serveFakeServer(t testing.TB, listener net.Listener, handshake func(fc *fakeConn) error) *fakeServer {
+	s := &fakeServer{
+		t:         t,
+		listener:  listener,
+		conns:     make(chan *fakeConn, 16),
+		handshake: handshake,
+	}
+
+	var (
+		mu       sync.Mutex
+		accepted []net.Conn
+	)
+
+	t.Cleanup(func() {
+		listener.Close()
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		for _, conn := range accepted {
+			conn.Close()
+		}
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			mu.Lock()
+			accepted = append(accepted, conn)
+			mu.Unlock()
+
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	fc := &fakeConn{
+		t:       s.t,
+		conn:    conn,
+		decoder: json.NewDecoder(conn),
+		encoder: json.NewEncoder(conn),
+	}
+
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	if err := s.handshake(fc); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	s.conns <- fc
+}
+
+func (s *fakeServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+// accept returns the next client that completed the handshake.
+func (s *fakeServer) accept() *fakeConn {
+	s.t.Helper()
+
+	select {
+	case fc := <-s.conns:
+		return fc
+	case <-time.After(testTimeout):
+		s.t.Fatal("no client connected")
+		return nil
+	}
+}
+
+// acceptTunnel reads the auth request and creates a tunnel.
+func acceptTunnel(fc *fakeConn) error {
+	auth, err := fc.readAuth()
+	if err != nil {
+		return err
+	}
+
+	fc.auth = auth
+
+	return fc.send(tunnelCreated("tunnel-1"))
+}
+
+// readAuth reads messages until the client's TunnelAuthRequest.
+func (fc *fakeConn) readAuth() (TunnelMessage, error) {
+	for {
+		var msg TunnelMessage
+		if err := fc.decoder.Decode(&msg); err != nil {
+			return TunnelMessage{}, err
+		}
+
+		if msg.Type == TunnelAuthRequest {
+			return msg, nil
+		}
+	}
+}
+
+func tunnelCreated(id string) TunnelMessage {
+	return TunnelMessage{
+		Type: TunnelCreated,
+		ID:   id,
+		Headers: map[string]string{
+			HeaderLocalUrl: "http://" + id + ".tunnel.test",
+			HeaderProdUrl:  "https://" + id + ".tunnel.test",
+		},
+	}
+}
+
+func (fc *fakeConn) send(msg TunnelMessage) error {
+	fc.encoderMu.Lock()
+	defer fc.encoderMu.Unlock()
+
+	return fc.encoder.Encode(msg)
+}
+
+// recv returns the next message from the client other than a keepalive
+// ping, which it answers, failing the test after testTimeout.
+func (fc *fakeConn) recv() TunnelMessage {
+	fc.t.Helper()
+
+	msg, err := fc.read()
+	if err != nil {
+		fc.t.Fatalf("reading from the client: %v", err)
+	}
+
+	return msg
+}
+
+func (fc *fakeConn) read() (TunnelMessage, error) {
+	fc.conn.SetReadDeadline(time.Now().Add(testTimeout))
+	defer fc.conn.SetReadDeadline(time.Time{})
+
+	for {
+		var msg TunnelMessage
+		if err := fc.decoder.Decode(&msg); err != nil {
+			return TunnelMessage{}, err
+		}
+
+		if msg.Type != TunnelPing {
+			return msg, nil
+		}
+
+		if err := fc.send(TunnelMessage{Type: TunnelPong, ID: msg.ID}); err != nil {
+			return TunnelMessage{}, err
+		}
+	}
+}
+
+// request sends msg as a TunnelRequest and returns the response, its chunks
+// joined when it is streamed.
+func (fc *fakeConn) request(msg TunnelMessage) TunnelMessage {
+	fc.t.Helper()
+
+	msg.Type = TunnelRequest
+	if err := fc.send(msg); err != nil {
+		fc.t.Fatal(err)
+	}
+
+	return fc.response(msg.ID)
+}
+
+// response reads messages until the whole response to request id.
+func (fc *fakeConn) response(id string) TunnelMessage {
+	fc.t.Helper()
+
+	responses := fc.responses(1)
+	resp, ok := responses[id]
+	if !ok {
+		fc.t.Fatalf("got a response to another request than %s", id)
+	}
+
+	return resp
+}
+
+// responses reads messages until n whole responses arrived, keyed by
+// request ID.
+func (fc *fakeConn) responses(n int) map[string]TunnelMessage {
+	fc.t.Helper()
+
+	var (
+		done      = make(map[string]TunnelMessage, n)
+		streaming = make(map[string]*TunnelMessage)
+	)
+
+	for len(done) < n {
+		msg := fc.recv()
+		if err := decodeBody(&msg); err != nil {
+			fc.t.Fatal(err)
+		}
+
+		switch msg.Type {
+		case TunnelResponse:
+			if msg.Headers[HeaderTunnelStreamed] != "" {
+				streaming[msg.ID] = &msg
+				continue
+			}
+
+			done[msg.ID] = msg
+		case TunnelResponseChunk:
+			resp, ok := streaming[msg.ID]
+			if !ok {
+				fc.t.Fatalf("chunk of unknown response %s", msg.ID)
+			}
+
+			if msg.Body != "" {
+				resp.Body += msg.Body
+				continue
+			}
+
+			for key, value := range msg.Headers {
+				resp.Headers[key] = value
+			}
+
+			delete(streaming, msg.ID)
+			done[msg.ID] = *resp
+		}
+	}
+
+	return done
+}
+
+func statusCode(t testing.TB, msg TunnelMessage) int {
+	t.Helper()
+
+	var status int
+	if _, err := fmt.Sscan(msg.Headers["X-Status-Code"], &status); err != nil {
+		t.Fatalf("response %s without status: %v", msg.ID, msg.Headers)
+	}
+
+	return status
+}
+
+// testSDKConfig returns an SDKConfig for server with callbacks doing
+// nothing, tests replace the ones they observe.
+func testSDKConfig(server *fakeServer) *SDKConfig {
+	return &SDKConfig{
+		TunnelServer:     server.addr(),
+		AuthToken:        "token",
+		OnAuth:           func(token string) {},
+		OnConnected:      func(localPort, localUrl, prodUrl, tunnelId string) {},
+		OnDisconnected:   func() {},
+		OnError:          func(err error) {},
+		OnRequest:        func(msg TunnelMessage) {},
+		OnSedingResponse: func(msg TunnelMessage, resp *http.Response, body []byte) {},
+	}
+}
+
+// testConfig returns the default tunnel config forwarding to 127.0.0.1.
+func testConfig() *TunnelConfig {
+	config := DefaultTunnelConfig
+	config.LocalHost = "127.0.0.1"
+
+	return &config
+}
+
+// backendPort starts an HTTP server with handler and returns its port.
+func backendPort(t testing.TB, handler http.Handler) string {
+	t.Helper()
+
+	backend := httptest.NewServer(handler)
+	t.Cleanup(backend.Close)
+
+	return urlPort(t, backend.URL)
+}
+
+// rawBackendPort starts a TCP server that reads each HTTP request and lets
+// respond write whatever it likes, even a response net/http wouldn't send,
+// then closes the connection. It returns the port.
+func rawBackendPort(t testing.TB, respond func(w io.Writer)) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+
+				respond(conn)
+			}()
+		}
+	}()
+
+	return urlPort(t, "http://"+listener.Addr().String())
+}
+
+func urlPort(t testing.TB, rawURL string) string {
+	t.Helper()
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return u.Port()
+}
+
+// startTunnel starts conn against server and returns the server side of
+// the connection once the tunnel is created.
+func startTunnel(t testing.TB, server *fakeServer, conn *TunnelConn) *fakeConn {
+	t.Helper()
+
+	started := make(chan error, 1)
+	go func() {
+		started <- conn.Start()
+	}()
+
+	t.Cleanup(func() {
+		conn.Stop()
+		<-started
+	})
+
+	fc := server.accept()
+	waitFor(t, func() bool { return conn.Status() == StatusConnected })
+
+	return fc
+}
+
+// newTestTunnel connects a tunnel forwarding to port with config, nil using
+// testConfig, to a new fake server.
+func newTestTunnel(t testing.TB, config *TunnelConfig, port string) (*TunnelConn, *fakeConn) {
+	t.Helper()
+
+	if config == nil {
+		config = testConfig()
+	}
+
+	server := newFakeServer(t)
+
+	conn, err := NewTunnelConn(config, testSDKConfig(server), port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn, startTunnel(t, server, conn)
+}
+
+// waitFor polls cond until it holds, failing the test after testTimeout.
+func waitFor(t testing.TB, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func BenchmarkReadBufferSize(b *testing.B) {
+	body := strings.Repeat("x", 64*1024)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	})
+
+	for _, size := range []int{4 * 1024, DefaultReadBufferSize, 256 * 1024} {
+		b.Run(fmt.Sprintf("%dKiB", size/1024), func(b *testing.B) {
+			config := testConfig()
+			config.ReadBufferSize = size
+			config.LocalHandler = handler
+
+			_, fc := newTestTunnel(b, config, "8080")
+
+			b.SetBytes(int64(len(body)))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				fc.request(TunnelMessage{ID: fmt.Sprint(i), Method: http.MethodPost, Path: "/", Body: body})
+			}
+		})
+	}
+}
+
+func TestPausedRequestsGet503(t *testing.T) {
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+
+	conn, fc := newTestTunnel(t, nil, port)
+
+	conn.Pause()
+
+	resp := fc.request(TunnelMessage{ID: "1", Method: http.MethodGet, Path: "/"})
+	if status := statusCode(t, resp); status != http.StatusServiceUnavailable {
+		t.Fatalf("status while paused = %d, want 503", status)
+	}
+
+	if retryAfter := resp.Headers["Retry-After"]; retryAfter != "30" {
+		t.Errorf("Retry-After = %q, want 30", retryAfter)
+	}
+
+	conn.Resume()
+
+	resp = fc.request(TunnelMessage{ID: "2", Method: http.MethodGet, Path: "/"})
+	if status := statusCode(t, resp); status != http.StatusOK || resp.Body != "ok" {
+		t.Fatalf("after resume got %d %q, want 200 \"ok\"", status, resp.Body)
+	}
+}
+
+func TestForwardedHostListUsesOneHost(t *testing.T) {
+	hosts := make(chan string, 1)
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts <- r.Host
+	}))
+
+	_, fc := newTestTunnel(t, nil, port)
+
+	fc.request(TunnelMessage{
+		ID:      "1",
+		Method:  http.MethodGet,
+		Path:    "/",
+		Headers: map[string]string{"X-Forwarded-Host": "app.example.com, edge.example.net"},
+	})
+
+	if host := <-hosts; host != "app.example.com" {
+		t.Fatalf("backend saw Host %q, want app.example.com", host)
+	}
+}
+
+// BenchmarkForwardSmallRequest measures a small request forwarded to a local
+// service and its response, run with -benchmem to follow the allocations
+// of the forwarding path.
+func BenchmarkForwardSmallRequest(b *testing.B) {
+	port := backendPort(b, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"ok":true}`)
+	}))
+
+	_, fc := newTestTunnel(b, nil, port)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		fc.request(TunnelMessage{
+			ID:      fmt.Sprint(i),
+			Method:  http.MethodPost,
+			Path:    "/api/items",
+			Headers: map[string]string{"Content-Type": "application/json"},
+			Body:    `{"name":"item"}`,
+		})
+	}
+}
+
+func TestNonStandardMethodsForwardedVerbatim(t *testing.T) {
+	methods := make(chan string, 1)
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods <- r.Method
+	}))
+
+	_, fc := newTestTunnel(t, nil, port)
+
+	for i, method := range []string{"PROPFIND", "FOOBAR"} {
+		resp := fc.request(TunnelMessage{ID: fmt.Sprint(i), Method: method, Path: "/dav/"})
+		if status := statusCode(t, resp); status != http.StatusOK {
+			t.Fatalf("%s answered %d", method, status)
+		}
+
+		if got := <-methods; got != method {
+			t.Errorf("backend got method %q, want %q", got, method)
+		}
+	}
+}
+
+func TestTLSFloorRefusesOlderServer(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(sdkConfig *SDKConfig)
+	}{
+		{"TLSConfig.MinVersion", func(sdkConfig *SDKConfig) {
+			sdkConfig.TLSConfig.MinVersion = tls.VersionTLS13
+		}},
+		{"MinTLSVersion", func(sdkConfig *SDKConfig) {
+			sdkConfig.MinTLSVersion = tls.VersionTLS13
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTLSFakeServer(t, &tls.Config{MaxVersion: tls.VersionTLS12})
+
+			sdkConfig := testSDKConfig(server)
+			sdkConfig.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+			tt.config(sdkConfig)
+
+			conn, err := NewTunnelConn(testConfig(), sdkConfig, "8080")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := conn.Connect(); err == nil {
+				conn.Stop()
+				t.Fatal("connected to a TLS 1.2 server with a TLS 1.3 floor")
+			}
+
+			if status := conn.Status(); status != StatusError {
+				t.Errorf("status = %s, want %s", status, StatusError)
+			}
+		})
+	}
+}
+
+// refuseAuth answers every auth request with a TunnelAuthFailure.
+func refuseAuth(fc *fakeConn) error {
+	if _, err := fc.readAuth(); err != nil {
+		return err
+	}
+
+	fc.send(TunnelMessage{Type: TunnelAuthFailure, Body: "invalid token"})
+
+	return errTestRefused
+}
+
+var errTestRefused = errors.New("refused by the test server")
+
+func TestReconnectStateCountsFailedAttempts(t *testing.T) {
+	server := newFakeServerWith(t, refuseAuth)
+
+	config := testConfig()
+	config.AutoReconnect = true
+	config.ReconnectBackoff = time.Millisecond
+	config.MaxReconnectAttempts = 3
+
+	conn, err := NewTunnelConn(config, testSDKConfig(server), "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Stop()
+
+	before := time.Now()
+	if err := conn.Start(); !errors.Is(err, ErrAuthFailure) {
+		t.Fatalf("Start() = %v, want ErrAuthFailure", err)
+	}
+
+	attempts, lastErr, since := conn.ReconnectState()
+	if attempts != 4 {
+		t.Errorf("attempts = %d, want the first connect and 3 reconnects", attempts)
+	}
+
+	if !errors.Is(lastErr, ErrAuthFailure) || !strings.Contains(lastErr.Error(), "invalid token") {
+		t.Errorf("last error = %v, want the auth failure", lastErr)
+	}
+
+	if since.Before(before) || since.After(time.Now()) {
+		t.Errorf("since = %v, want the first failure", since)
+	}
+}
+
+func TestRequestBeforeTunnelCreatedIsBuffered(t *testing.T) {
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "early")
+	}))
+
+	server := newFakeServerWith(t, func(fc *fakeConn) error {
+		if _, err := fc.readAuth(); err != nil {
+			return err
+		}
+
+		if err := fc.send(TunnelMessage{Type: TunnelRequest, ID: "early-1", Method: http.MethodGet, Path: "/"}); err != nil {
+			return err
+		}
+
+		return fc.send(tunnelCreated("tunnel-1"))
+	})
+
+	conn, err := NewTunnelConn(testConfig(), testSDKConfig(server), port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fc := startTunnel(t, server, conn)
+
+	resp := fc.response("early-1")
+	if status := statusCode(t, resp); status != http.StatusOK || resp.Body != "early" {
+		t.Fatalf("early request answered %d %q, want 200 \"early\"", status, resp.Body)
+	}
+}
+
+func TestLocalHandlerServesInProcess(t *testing.T) {
+	config := testConfig()
+	config.LocalHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		w.Header().Set("X-Handler", "in-process")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, body)
+	})
+
+	// nothing listens on the port, the handler must answer instead
+	_, fc := newTestTunnel(t, config, "1")
+
+	resp := fc.request(TunnelMessage{ID: "1", Method: http.MethodPut, Path: "/items/7", Body: "data"})
+	if status := statusCode(t, resp); status != http.StatusCreated {
+		t.Fatalf("status = %d, want 201", status)
+	}
+
+	if resp.Headers["X-Handler"] != "in-process" || resp.Body != "PUT /items/7 data" {
+		t.Errorf("response = %v %q, want the handler's", resp.Headers, resp.Body)
+	}
+}
+
+// TestConcurrentTrafficAndStop is meant for -race: requests and pings are
+// read and answered concurrently, then Stop must leave no goroutine behind.
+func TestConcurrentTrafficAndStop(t *testing.T) {
+	server := newFakeServer(t)
+	baseline := runtime.NumGoroutine()
+
+	config := testConfig()
+	config.LocalHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})
+
+	conn, err := NewTunnelConn(config, testSDKConfig(server), "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan error, 1)
+	go func() {
+		started <- conn.Start()
+	}()
+
+	fc := server.accept()
+
+	const requests = 50
+
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			fc.send(TunnelMessage{Type: TunnelRequest, ID: fmt.Sprint(i), Method: http.MethodPost, Path: "/", Body: fmt.Sprint("body-", i)})
+			fc.send(TunnelMessage{Type: TunnelPing, ID: fmt.Sprint("ping-", i)})
+		}()
+	}
+
+	responses := make(map[string]TunnelMessage, requests)
+	pongs := 0
+	for len(responses) < requests || pongs < requests {
+		msg := fc.recv()
+		switch msg.Type {
+		case TunnelPong:
+			pongs++
+		case TunnelResponse:
+			responses[msg.ID] = msg
+		}
+	}
+
+	wg.Wait()
+
+	for i := 0; i < requests; i++ {
+		if resp := responses[fmt.Sprint(i)]; resp.Body != fmt.Sprint("body-", i) {
+			t.Errorf("response %d = %q", i, resp.Body)
+		}
+	}
+
+	if err := conn.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatalf("Start() = %v after Stop", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Start didn't return after Stop")
+	}
+
+	waitFor(t, func() bool { return runtime.NumGoroutine() <= baseline })
+}
+
+// TestStopRacingConnect is meant for -race: Stop may run before, during or
+// after the handshake publishes the connection, and must close it anyway.
+func TestStopRacingConnect(t *testing.T) {
+	server := newFakeServer(t)
+
+	for i := 0; i < 20; i++ {
+		conn, err := NewTunnelConn(testConfig(), testSDKConfig(server), "8080")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		started := make(chan error, 1)
+		go func() {
+			started <- conn.Start()
+		}()
+
+		time.Sleep(time.Duration(i) * 100 * time.Microsecond)
+		conn.Stop()
+
+		select {
+		case <-started:
+		case <-time.After(testTimeout):
+			t.Fatalf("Start didn't return after Stop (iteration %d)", i)
+		}
+
+		if status := conn.Status(); status != StatusDisconnected && status != StatusError {
+			t.Fatalf("status after Stop = %s", status)
+		}
+	}
+}
+
+func TestEarlyHintsPrecedeResponse(t *testing.T) {
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+
+		time.Sleep(20 * time.Millisecond)
+		io.WriteString(w, "page")
+	}))
+
+	config := testConfig()
+	config.ForwardEarlyHints = true
+
+	_, fc := newTestTunnel(t, config, port)
+
+	fc.send(TunnelMessage{Type: TunnelRequest, ID: "1", Method: http.MethodGet, Path: "/"})
+
+	hints := fc.recv()
+	if hints.Type != TunnelEarlyHints || hints.ID != "1" {
+		t.Fatalf("first message = type %d for %q, want early hints for 1", hints.Type, hints.ID)
+	}
+
+	if status := statusCode(t, hints); status != http.StatusEarlyHints {
+		t.Errorf("early hints status = %d, want 103", status)
+	}
+
+	if link := hints.Headers["Link"]; link != "</style.css>; rel=preload; as=style" {
+		t.Errorf("early hints Link = %q", link)
+	}
+
+	resp := fc.response("1")
+	if status := statusCode(t, resp); status != http.StatusOK || resp.Body != "page" {
+		t.Errorf("final response = %d %q, want 200 \"page\"", status, resp.Body)
+	}
+}
+
+func TestControlInvokedOnDial(t *testing.T) {
+	server := newFakeServer(t)
+
+	var dialed atomic.Value
+	sdkConfig := testSDKConfig(server)
+	sdkConfig.Control = func(network, address string, c syscall.RawConn) error {
+		dialed.Store(network + " " + address)
+		return nil
+	}
+
+	conn, err := NewTunnelConn(testConfig(), sdkConfig, "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startTunnel(t, server, conn)
+
+	if got, want := dialed.Load(), "tcp4 "+server.addr(); got != want {
+		t.Fatalf("Control called with %v, want %q", got, want)
+	}
+}
+
+func TestAuthTimeoutIsRetried(t *testing.T) {
+	var attempts atomic.Int32
+	server := newFakeServerWith(t, func(fc *fakeConn) error {
+		if _, err := fc.readAuth(); err != nil {
+			return err
+		}
+
+		attempts.Add(1)
+
+		// never answer, wait for the client to give up
+		_, err := fc.readAuth()
+		return err
+	})
+
+	config := testConfig()
+	config.AuthTimeout = 50 * time.Millisecond
+	config.AutoReconnect = true
+	config.ReconnectBackoff = time.Millisecond
+	config.MaxReconnectAttempts = 2
+
+	conn, err := NewTunnelConn(config, testSDKConfig(server), "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Stop()
+
+	if err := conn.Start(); !errors.Is(err, ErrTunnelTimeout) {
+		t.Fatalf("Start() = %v, want ErrTunnelTimeout", err)
+	}
+
+	if n := attempts.Load(); n != 3 {
+		t.Errorf("server saw %d auth attempts, want the first connect and 2 reconnects", n)
+	}
+}
+
+func TestConnectWithResultExposesCreatedHeaders(t *testing.T) {
+	server := newFakeServerWith(t, func(fc *fakeConn) error {
+		if _, err := fc.readAuth(); err != nil {
+			return err
+		}
+
+		created := tunnelCreated("tunnel-9")
+		created.Headers["X-Region"] = "eu-west"
+		created.Headers["X-Plan"] = "pro"
+
+		return fc.send(created)
+	})
+
+	conn, err := NewTunnelConn(testConfig(), testSDKConfig(server), "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Stop()
+
+	created, err := conn.ConnectWithResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if created.ID != "tunnel-9" || created.Headers["X-Region"] != "eu-west" || created.Headers["X-Plan"] != "pro" {
+		t.Errorf("ConnectWithResult() = %+v, missing the server's headers", created)
+	}
+
+	if created.Headers[HeaderProdUrl] != "https://tunnel-9.tunnel.test" {
+		t.Errorf("Prod-URL = %q", created.Headers[HeaderProdUrl])
+	}
+}
+
+func TestMethodOverride(t *testing.T) {
+	type seen struct{ method, override string }
+	requests := make(chan seen, 1)
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- seen{r.Method, r.Header.Get(HeaderMethodOverride)}
+	}))
+
+	config := testConfig()
+	config.AllowMethodOverride = true
+
+	_, fc := newTestTunnel(t, config, port)
+
+	fc.request(TunnelMessage{
+		ID:      "1",
+		Method:  http.MethodPost,
+		Path:    "/items/1",
+		Headers: map[string]string{HeaderMethodOverride: "DELETE"},
+	})
+
+	if got := <-requests; got.method != http.MethodDelete || got.override != "" {
+		t.Fatalf("backend got %s with override %q, want DELETE without it", got.method, got.override)
+	}
+}
+
+func TestTimeoutMidBodyForwardsTruncatedBody(t *testing.T) {
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-r.Context().Done():
+		case <-time.After(testTimeout):
+		}
+	}))
+
+	config := testConfig()
+	config.ResponseTimeout = 100 * time.Millisecond
+
+	_, fc := newTestTunnel(t, config, port)
+
+	resp := fc.request(TunnelMessage{ID: "1", Method: http.MethodGet, Path: "/"})
+	if status := statusCode(t, resp); status != http.StatusOK {
+		t.Fatalf("status = %d, want the backend's 200", status)
+	}
+
+	if resp.Body != "partial" || resp.Headers[HeaderTunnelTruncated] != "true" {
+		t.Errorf("got %q with headers %v, want \"partial\" marked truncated", resp.Body, resp.Headers)
+	}
+}
+
+func TestUnsupportedServerProtocolVersion(t *testing.T) {
+	server := newFakeServerWith(t, func(fc *fakeConn) error {
+		if _, err := fc.readAuth(); err != nil {
+			return err
+		}
+
+		created := tunnelCreated("tunnel-1")
+		created.Headers[HeaderProtocolVersion] = "99"
+
+		return fc.send(created)
+	})
+
+	conn, err := NewTunnelConn(testConfig(), testSDKConfig(server), "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Stop()
+
+	if err := conn.Connect(); !errors.Is(err, ErrUnsupportedProtocolVersion) {
+		t.Fatalf("Connect() = %v, want ErrUnsupportedProtocolVersion", err)
+	}
+}
+
+func TestPortMapRoutesToBackends(t *testing.T) {
+	backend := func(name string) string {
+		return backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+	}
+
+	config := testConfig()
+	config.PortMap = map[string]string{
+		"443":  backend("web"),
+		"8443": backend("api"),
+	}
+
+	_, fc := newTestTunnel(t, config, backend("default"))
+
+	for i, tt := range []struct{ publicPort, want string }{
+		{"443", "web"},
+		{"8443", "api"},
+		{"9999", "default"},
+	} {
+		resp := fc.request(TunnelMessage{
+			ID:      fmt.Sprint(i),
+			Method:  http.MethodGet,
+			Path:    "/",
+			Headers: map[string]string{HeaderForwardedPort: tt.publicPort},
+		})
+
+		if resp.Body != tt.want {
+			t.Errorf("port %s reached %q, want %q", tt.publicPort, resp.Body, tt.want)
+		}
+	}
+}
+
+func TestUploadFraming(t *testing.T) {
+	type framing struct {
+		contentLength    int64
+		transferEncoding []string
+		body             string
+	}
+
+	seen := make(chan framing, 1)
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		seen <- framing{r.ContentLength, r.TransferEncoding, string(body)}
+	}))
+
+	_, fc := newTestTunnel(t, nil, port)
+
+	fc.request(TunnelMessage{
+		ID:      "fixed",
+		Method:  http.MethodPost,
+		Path:    "/",
+		Headers: map[string]string{"Content-Length": "5"},
+		Body:    "hello",
+	})
+
+	if got := <-seen; got.contentLength != 5 || len(got.transferEncoding) != 0 || got.body != "hello" {
+		t.Errorf("fixed-length upload seen as %+v", got)
+	}
+
+	fc.request(TunnelMessage{
+		ID:      "chunked",
+		Method:  http.MethodPost,
+		Path:    "/",
+		Headers: map[string]string{"Transfer-Encoding": "chunked"},
+		Body:    "hello chunks",
+	})
+
+	if got := <-seen; got.contentLength != -1 || len(got.transferEncoding) != 1 || got.transferEncoding[0] != "chunked" || got.body != "hello chunks" {
+		t.Errorf("chunked upload seen as %+v", got)
+	}
+}
+
+func TestStripConnectionCloseKeepsBackendAlive(t *testing.T) {
+	for _, strip := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strip=%v", strip), func(t *testing.T) {
+			var dials atomic.Int32
+			backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "ok")
+			}))
+			backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					dials.Add(1)
+				}
+			}
+			backend.Start()
+			t.Cleanup(backend.Close)
+
+			config := testConfig()
+			config.StripConnectionClose = strip
+
+			_, fc := newTestTunnel(t, config, urlPort(t, backend.URL))
+
+			const requests = 3
+			for i := 0; i < requests; i++ {
+				fc.request(TunnelMessage{
+					ID:      fmt.Sprint(i),
+					Method:  http.MethodGet,
+					Path:    "/",
+					Headers: map[string]string{"Connection": "close"},
+				})
+			}
+
+			want := int32(requests)
+			if strip {
+				want = 1
+			}
+
+			if got := dials.Load(); got != want {
+				t.Errorf("%d backend connections for %d requests, want %d", got, requests, want)
+			}
+		})
+	}
+}
+
+func TestOversizedResponseHeaderDropped(t *testing.T) {
+	huge := strings.Repeat("x", 2<<20)
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", huge)
+		w.Header().Set("X-Small", "kept")
+		io.WriteString(w, "ok")
+	}))
+
+	errs := make(chan error, 1)
+	server := newFakeServer(t)
+	sdkConfig := testSDKConfig(server)
+	sdkConfig.OnError = func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+
+	conn, err := NewTunnelConn(testConfig(), sdkConfig, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fc := startTunnel(t, server, conn)
+
+	resp := fc.request(TunnelMessage{ID: "1", Method: http.MethodGet, Path: "/"})
+	if status := statusCode(t, resp); status != http.StatusOK || resp.Body != "ok" {
+		t.Fatalf("got %d %q, want 200 \"ok\"", status, resp.Body)
+	}
+
+	if _, ok := resp.Headers["Content-Security-Policy"]; ok {
+		t.Error("multi-megabyte header forwarded")
+	}
+
+	if resp.Headers["X-Small"] != "kept" {
+		t.Errorf("X-Small = %q, want kept", resp.Headers["X-Small"])
+	}
+
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "Content-Security-Policy") {
+			t.Errorf("warning %q does not name the header", err)
+		}
+	default:
+		t.Error("dropped header not reported")
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	for _, jsonErrors := range []bool{false, true} {
+		t.Run(fmt.Sprintf("json=%v", jsonErrors), func(t *testing.T) {
+			config := testConfig()
+			config.JSONErrors = jsonErrors
+
+			conn, fc := newTestTunnel(t, config, "8080")
+			conn.Pause()
+
+			resp := fc.request(TunnelMessage{ID: "1", Method: http.MethodGet, Path: "/"})
+			if status := statusCode(t, resp); status != http.StatusServiceUnavailable {
+				t.Fatalf("status = %d, want 503", status)
+			}
+
+			contentType := resp.Headers["Content-Type"]
+
+			if !jsonErrors {
+				if contentType != "text/plain; charset=utf-8" || !strings.HasPrefix(resp.Body, "503 Service Unavailable: ") {
+					t.Errorf("got %q with Content-Type %q, want the plain text error", resp.Body, contentType)
+				}
+
+				return
+			}
+
+			if contentType != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", contentType)
+			}
+
+			var body struct {
+				Error struct {
+					Code    int    `json:"code"`
+					Message string `json:"message"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+				t.Fatalf("body %q: %v", resp.Body, err)
+			}
+
+			if body.Error.Code != http.StatusServiceUnavailable || body.Error.Message == "" {
+				t.Errorf("error body = %q, want code 503 with a message", resp.Body)
+			}
+		})
+	}
+}
+
+func TestCancelledRequestAbortsBackend(t *testing.T) {
+	started := make(chan struct{})
+	aborted := make(chan struct{})
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first chunk")
+		w.(http.Flusher).Flush()
+		close(started)
+
+		select {
+		case <-r.Context().Done():
+			close(aborted)
+		case <-time.After(testTimeout):
+		}
+	}))
+
+	_, fc := newTestTunnel(t, nil, port)
+
+	if err := fc.send(TunnelMessage{Type: TunnelRequest, ID: "1", Method: http.MethodGet, Path: "/download"}); err != nil {
+		t.Fatal(err)
+	}
+
+	<-started
+
+	if err := fc.send(TunnelMessage{Type: TunnelRequestCancelled, ID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-aborted:
+	case <-time.After(testTimeout):
+		t.Fatal("backend request not aborted after the cancellation")
+	}
+}
+
+func TestInFlightTracksConcurrentRequests(t *testing.T) {
+	const requests = 20
+
+	var arrived sync.WaitGroup
+	arrived.Add(requests)
+	release := make(chan struct{})
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived.Done()
+		<-release
+	}))
+
+	config := testConfig()
+	config.MaxConcurrentRequests = requests
+
+	conn, fc := newTestTunnel(t, config, port)
+
+	var senders sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+
+			msg := TunnelMessage{Type: TunnelRequest, ID: fmt.Sprint(i), Method: http.MethodGet, Path: fmt.Sprintf("/%d", i)}
+			if err := fc.send(msg); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	senders.Wait()
+	arrived.Wait()
+
+	inflight := conn.InFlight()
+	if len(inflight) != requests {
+		t.Fatalf("%d requests in flight, want %d", len(inflight), requests)
+	}
+
+	for _, request := range inflight {
+		if request.Path != "/"+request.ID || request.Method != http.MethodGet || request.Started.IsZero() {
+			t.Errorf("in-flight request %+v does not match what was sent", request)
+		}
+	}
+
+	close(release)
+	fc.responses(requests)
+
+	waitFor(t, func() bool { return len(conn.InFlight()) == 0 })
+}
+
+func TestRequestPathValidation(t *testing.T) {
+	paths := make(chan string, 1)
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.RequestURI()
+	}))
+
+	_, fc := newTestTunnel(t, nil, port)
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantPath   string
+	}{
+		{"", http.StatusOK, "/"},
+		{"/", http.StatusOK, "/"},
+		{"/users/42?active=true", http.StatusOK, "/users/42?active=true"},
+		{"users", http.StatusBadRequest, ""},
+		{"http://evil.example/", http.StatusBadRequest, ""},
+	}
+
+	for i, tt := range tests {
+		resp := fc.request(TunnelMessage{ID: fmt.Sprint(i), Method: http.MethodGet, Path: tt.path})
+		if status := statusCode(t, resp); status != tt.wantStatus {
+			t.Errorf("path %q answered %d, want %d", tt.path, status, tt.wantStatus)
+			continue
+		}
+
+		if tt.wantStatus != http.StatusOK {
+			continue
+		}
+
+		if got := <-paths; got != tt.wantPath {
+			t.Errorf("path %q reached the backend as %q, want %q", tt.path, got, tt.wantPath)
+		}
+	}
+}
+
+func TestConcurrentStartConnectsOnce(t *testing.T) {
+	const starts = 8
+
+	server := newFakeServer(t)
+	conn, err := NewTunnelConn(testConfig(), testSDKConfig(server), "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(chan error, starts)
+	for i := 0; i < starts; i++ {
+		go func() {
+			results <- conn.Start()
+		}()
+	}
+
+	for i := 0; i < starts-1; i++ {
+		if err := <-results; !errors.Is(err, ErrAlreadyStarted) {
+			t.Fatalf("concurrent Start = %v, want ErrAlreadyStarted", err)
+		}
+	}
+
+	server.accept()
+	waitFor(t, func() bool { return conn.Status() == StatusConnected })
+
+	select {
+	case <-server.conns:
+		t.Error("a second connection was established")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	conn.Stop()
+	if err := <-results; err != nil {
+		t.Errorf("running Start = %v after Stop", err)
+	}
+}
+
+func TestLocationRewrittenToPublicURL(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/foo/", func(w http.ResponseWriter, r *http.Request) {})
+	// redirect to an absolute URL built from the Host header, as many
+	// frameworks do for trailing-slash redirects
+	mux.HandleFunc("/foo", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://"+r.Host+"/foo/?page=2", http.StatusMovedPermanently)
+	})
+	port := backendPort(t, mux)
+
+	for _, rewrite := range []bool{false, true} {
+		t.Run(fmt.Sprintf("rewrite=%v", rewrite), func(t *testing.T) {
+			config := testConfig()
+			config.RewriteLocation = rewrite
+
+			conn, fc := newTestTunnel(t, config, port)
+
+			resp := fc.request(TunnelMessage{ID: "1", Method: http.MethodGet, Path: "/foo"})
+			if !rewrite {
+				// followed locally, the public client never sees it
+				if status := statusCode(t, resp); status != http.StatusOK {
+					t.Errorf("status = %d, want 200 from the followed redirect", status)
+				}
+
+				return
+			}
+
+			if status := statusCode(t, resp); status != http.StatusMovedPermanently {
+				t.Fatalf("status = %d, want 301", status)
+			}
+
+			_, prodURL := conn.URLs()
+			if location, want := resp.Headers["Location"], prodURL+"/foo/?page=2"; location != want {
+				t.Errorf("Location = %q, want %q", location, want)
+			}
+		})
+	}
+}
+
+func TestRequestEditor(t *testing.T) {
+	headers := make(chan string, 1)
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Get("X-Edited")
+	}))
+
+	config := testConfig()
+	config.RequestEditor = func(req *http.Request) error {
+		if req.URL.Path == "/forbidden" {
+			return errors.New("path not allowed")
+		}
+
+		req.Header.Set("X-Edited", "yes")
+		return nil
+	}
+
+	_, fc := newTestTunnel(t, config, port)
+
+	resp := fc.request(TunnelMessage{ID: "1", Method: http.MethodGet, Path: "/"})
+	if status := statusCode(t, resp); status != http.StatusOK {
+		t.Fatalf("status = %d, want 200", status)
+	}
+
+	if got := <-headers; got != "yes" {
+		t.Errorf("backend got X-Edited %q, want yes", got)
+	}
+
+	resp = fc.request(TunnelMessage{ID: "2", Method: http.MethodGet, Path: "/forbidden"})
+	if status := statusCode(t, resp); status != http.StatusBadRequest || !strings.Contains(resp.Body, "path not allowed") {
+		t.Errorf("editor error answered %d %q, want 400 with the error", status, resp.Body)
+	}
+
+	select {
+	case <-headers:
+		t.Error("request rejected by the editor reached the backend")
+	default:
+	}
+}
+
+func TestHostOverride(t *testing.T) {
+	hosts := make(chan string, 1)
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts <- r.Host
+	}))
+
+	config := testConfig()
+	config.HostOverride = "example.com"
+
+	_, fc := newTestTunnel(t, config, port)
+
+	fc.request(TunnelMessage{
+		ID:      "1",
+		Method:  http.MethodGet,
+		Path:    "/",
+		Headers: map[string]string{"Host": "public.tunnel.test", "X-Forwarded-Host": "public.tunnel.test"},
+	})
+
+	if host := <-hosts; host != "example.com" {
+		t.Errorf("backend saw Host %q, want example.com", host)
+	}
+}
+
+func TestArtificialDelay(t *testing.T) {
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+
+	const delay = 200 * time.Millisecond
+
+	config := testConfig()
+	config.ArtificialDelay = delay
+
+	_, fc := newTestTunnel(t, config, port)
+
+	start := time.Now()
+	fc.request(TunnelMessage{ID: "1", Method: http.MethodGet, Path: "/"})
+
+	if elapsed := time.Since(start); elapsed < delay || elapsed > delay+time.Second {
+		t.Errorf("response took %v, want about %v", elapsed, delay)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	methods := make(chan string, 1)
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods <- r.Method
+	}))
+
+	config := testConfig()
+	config.ReadOnly = true
+
+	_, fc := newTestTunnel(t, config, port)
+
+	for i, method := range []string{http.MethodGet, http.MethodHead, http.MethodOptions} {
+		resp := fc.request(TunnelMessage{ID: fmt.Sprint("safe", i), Method: method, Path: "/"})
+		if status := statusCode(t, resp); status != http.StatusOK {
+			t.Errorf("%s answered %d, want 200", method, status)
+		}
+
+		if got := <-methods; got != method {
+			t.Errorf("backend got %s, want %s", got, method)
+		}
+	}
+
+	for i, method := range []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		resp := fc.request(TunnelMessage{ID: fmt.Sprint("mutating", i), Method: method, Path: "/"})
+		if status := statusCode(t, resp); status != http.StatusMethodNotAllowed {
+			t.Errorf("%s answered %d, want 405", method, status)
+		}
+
+		if allow := resp.Headers["Allow"]; allow != "GET, HEAD, OPTIONS" {
+			t.Errorf("%s answered with Allow %q", method, allow)
+		}
+	}
+
+	select {
+	case method := <-methods:
+		t.Errorf("%s reached the backend in read-only mode", method)
+	default:
+	}
+}
+
+func TestControlTLSState(t *testing.T) {
+	suites := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+	server := newTLSFakeServer(t, &tls.Config{
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: suites,
+	})
+
+	sdkConfig := testSDKConfig(server)
+	sdkConfig.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+
+	conn, err := NewTunnelConn(testConfig(), sdkConfig, "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startTunnel(t, server, conn)
+
+	state := conn.ControlTLSState()
+	if state == nil {
+		t.Fatal("no TLS state over a TLS control connection")
+	}
+
+	if state.Version != tls.VersionTLS12 || !slices.Contains(suites, state.CipherSuite) {
+		t.Errorf("negotiated %s with %s, want TLS 1.2 with an AES-128-GCM suite",
+			tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	}
+
+	plain, _ := newTestTunnel(t, nil, "8080")
+	if state := plain.ControlTLSState(); state != nil {
+		t.Errorf("plaintext control connection reports TLS state %+v", state)
+	}
+}
+
+func TestUptimeResetsOnReconnect(t *testing.T) {
+	server := newFakeServer(t)
+
+	config := testConfig()
+	config.AutoReconnect = true
+	config.ReconnectBackoff = time.Millisecond
+
+	conn, err := NewTunnelConn(config, testSDKConfig(server), "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now()
+	fc := startTunnel(t, server, conn)
+
+	connectedAt := conn.ConnectedAt()
+	if connectedAt.Before(before) || connectedAt.After(time.Now()) {
+		t.Fatalf("ConnectedAt = %v, want the time of the connect", connectedAt)
+	}
+
+	first := conn.Uptime()
+	time.Sleep(50 * time.Millisecond)
+	if second := conn.Uptime(); second < first+50*time.Millisecond {
+		t.Fatalf("uptime went from %v to %v in 50ms", first, second)
+	}
+
+	uptime := conn.Uptime()
+	fc.conn.Close()
+	server.accept()
+	waitFor(t, func() bool {
+		return conn.Status() == StatusConnected && conn.ConnectedAt().After(connectedAt)
+	})
+
+	if after := conn.Uptime(); after >= uptime {
+		t.Errorf("uptime after reconnect = %v, want it reset below %v", after, uptime)
+	}
+
+	conn.Stop()
+	if uptime := conn.Uptime(); uptime != 0 || !conn.ConnectedAt().IsZero() {
+		t.Errorf("after Stop uptime = %v, ConnectedAt = %v, want both zero", uptime, conn.ConnectedAt())
+	}
+}
+
+func TestMessagesAfterStopReportNoError(t *testing.T) {
+	server := newFakeServer(t)
+
+	var errs atomic.Int32
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+
+	sdkConfig := testSDKConfig(server)
+	sdkConfig.SigningSecret = testSigningSecret
+	// the first unsigned request is reported from the read loop, holding it
+	// while the tunnel is stopped with the second one buffered
+	sdkConfig.OnError = func(err error) {
+		if errs.Add(1) == 1 {
+			close(blocked)
+			<-release
+		}
+	}
+
+	conn, err := NewTunnelConn(testConfig(), sdkConfig, "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fc := startTunnel(t, server, conn)
+
+	for _, id := range []string{"1", "2"} {
+		if err := fc.send(TunnelMessage{Type: TunnelRequest, ID: id, Method: http.MethodGet, Path: "/"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	<-blocked
+	conn.Stop()
+	close(release)
+
+	time.Sleep(50 * time.Millisecond)
+	if n := errs.Load(); n != 1 {
+		t.Errorf("OnError called %d times, want only for the request before Stop", n)
+	}
+}
+
+func TestMaskStatusCodes(t *testing.T) {
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/crash" {
+			http.Error(w, "panic: nil pointer dereference at main.go:42", http.StatusInternalServerError)
+			return
+		}
+
+		http.Error(w, "no such page", http.StatusNotFound)
+	}))
+
+	const maintenance = "<h1>Back soon</h1>"
+
+	config := testConfig()
+	config.MaskStatusCodes = []int{http.StatusInternalServerError}
+	config.MaskedBody = maintenance
+
+	_, fc := newTestTunnel(t, config, port)
+
+	resp := fc.request(TunnelMessage{ID: "1", Method: http.MethodGet, Path: "/crash"})
+	if status := statusCode(t, resp); status != http.StatusServiceUnavailable || resp.Body != maintenance {
+		t.Errorf("masked 500 answered %d %q, want 503 with the maintenance page", status, resp.Body)
+	}
+
+	if contentType := resp.Headers["Content-Type"]; contentType != "text/html; charset=utf-8" {
+		t.Errorf("maintenance page served as %q", contentType)
+	}
+
+	resp = fc.request(TunnelMessage{ID: "2", Method: http.MethodGet, Path: "/missing"})
+	if status := statusCode(t, resp); status != http.StatusNotFound {
+		t.Errorf("unmasked 404 answered %d", status)
+	}
+}
+
+func TestBackendResetMidBody(t *testing.T) {
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 100\r\n\r\npartial")
+		buf.Flush()
+
+		// reset instead of a clean close
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}))
+
+	tests := []struct {
+		policy     PartialResponsePolicy
+		wantStatus int
+		wantBody   string
+	}{
+		{PartialResponseError, http.StatusInternalServerError, ""},
+		{PartialResponseForward, http.StatusOK, "partial"},
+	}
+
+	for _, tt := range tests {
+		config := testConfig()
+		config.PartialResponsePolicy = tt.policy
+
+		_, fc := newTestTunnel(t, config, port)
+
+		resp := fc.request(TunnelMessage{ID: "1", Method: http.MethodGet, Path: "/"})
+		status := statusCode(t, resp)
+		if status != tt.wantStatus {
+			t.Errorf("policy %d answered %d, want %d", tt.policy, status, tt.wantStatus)
+			continue
+		}
+
+		if tt.policy != PartialResponseForward {
+			if resp.Headers[HeaderTunnelIncomplete] != "" {
+				t.Errorf("error response marked incomplete")
+			}
+
+			continue
+		}
+
+		if resp.Body != tt.wantBody || resp.Headers[HeaderTunnelIncomplete] != "true" {
+			t.Errorf("got %q with headers %v, want %q marked incomplete", resp.Body, resp.Headers, tt.wantBody)
+		}
+
+		if length := resp.Headers["Content-Length"]; length == "100" {
+			t.Error("partial body forwarded with the original Content-Length")
+		}
+	}
+}
+
+func TestSessionResumedAfterRestart(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		sessions = make(map[string]string) // resume token -> tunnel ID
+		created  int
+	)
+
+	server := newFakeServerWith(t, func(fc *fakeConn) error {
+		auth, err := fc.readAuth()
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		id, ok := sessions[auth.Headers[HeaderResumeToken]]
+		if !ok {
+			created++
+			id = fmt.Sprintf("tunnel-%d", created)
+		}
+
+		token := "resume-" + id
+		sessions[token] = id
+
+		msg := tunnelCreated(id)
+		msg.Headers[HeaderResumeToken] = token
+
+		return fc.send(msg)
+	})
+
+	config := testConfig()
+	config.SessionTokenPath = filepath.Join(t.TempDir(), "session")
+
+	run := func() (string, string) {
+		conn, err := NewTunnelConn(config, testSDKConfig(server), "8080")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		startTunnel(t, server, conn)
+		defer conn.Stop()
+
+		_, prodURL := conn.URLs()
+		return conn.TunnelID(), prodURL
+	}
+
+	firstID, firstURL := run()
+
+	if token, err := os.ReadFile(config.SessionTokenPath); err != nil || string(token) != "resume-"+firstID {
+		t.Fatalf("saved session token %q, %v", token, err)
+	}
+
+	// a restarted client presents the saved token
+	if id, prodURL := run(); id != firstID || prodURL != firstURL {
+		t.Errorf("restart got tunnel %s at %s, want %s at %s reattached", id, prodURL, firstID, firstURL)
+	}
+
+	config.SessionTokenPath = ""
+	if id, _ := run(); id == firstID {
+		t.Errorf("client without a session token reattached %s", id)
+	}
+}
+
+func TestReconnectAfterDrop(t *testing.T) {
+	var handshakes atomic.Int32
+	server := newFakeServerWith(t, func(fc *fakeConn) error {
+		// the first connect fails and is retried like a drop
+		if handshakes.Add(1) == 1 {
+			return refuseAuth(fc)
+		}
+
+		return acceptTunnel(fc)
+	})
+
+	var connected, disconnected atomic.Int32
+	sdkConfig := testSDKConfig(server)
+	sdkConfig.OnConnected = func(localPort, localUrl, prodUrl, tunnelId string) { connected.Add(1) }
+	sdkConfig.OnDisconnected = func() { disconnected.Add(1) }
+
+	// long enough for the reconnecting status to be observed
+	config := testConfig()
+	config.AutoReconnect = true
+	config.ReconnectBackoff = 100 * time.Millisecond
+	config.BackoffJitter = BackoffNoJitter
+
+	conn, err := NewTunnelConn(config, sdkConfig, "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fc := startTunnel(t, server, conn)
+	if n := connected.Load(); n != 1 {
+		t.Fatalf("OnConnected called %d times after the retried first connect, want 1", n)
+	}
+
+	fc.conn.Close()
+	waitFor(t, func() bool { return conn.Status() == StatusReconnecting })
+
+	server.accept()
+	waitFor(t, func() bool { return conn.Status() == StatusConnected })
+
+	if c, d := connected.Load(), disconnected.Load(); c != 2 || d != 1 {
+		t.Errorf("OnConnected called %d times and OnDisconnected %d, want 2 and 1", c, d)
+	}
+}
+
+func TestStopAbortsPendingReconnect(t *testing.T) {
+	server := newFakeServer(t)
+
+	config := testConfig()
+	config.AutoReconnect = true
+	config.ReconnectBackoff = time.Minute
+	config.BackoffJitter = BackoffNoJitter
+
+	conn, err := NewTunnelConn(config, testSDKConfig(server), "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan error, 1)
+	go func() {
+		started <- conn.Start()
+	}()
+
+	fc := server.accept()
+	waitFor(t, func() bool { return conn.Status() == StatusConnected })
+
+	fc.conn.Close()
+	waitFor(t, func() bool { return conn.Status() == StatusReconnecting })
+
+	conn.Stop()
+
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Errorf("Start = %v after Stop, want nil", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Stop didn't abort the pending reconnect")
+	}
+
+	if status := conn.Status(); status != StatusDisconnected {
+		t.Errorf("status = %s after Stop, want %s", status, StatusDisconnected)
+	}
+}
+
+func TestStopTwice(t *testing.T) {
+	server := newFakeServer(t)
+
+	var disconnects atomic.Int32
+	sdkConfig := testSDKConfig(server)
+	sdkConfig.OnDisconnected = func() { disconnects.Add(1) }
+
+	// never started
+	idle, err := NewTunnelConn(testConfig(), sdkConfig, "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idle.Stop()
+	idle.Stop()
+
+	conn, err := NewTunnelConn(testConfig(), sdkConfig, "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startTunnel(t, server, conn)
+
+	conn.Stop()
+	conn.Stop()
+
+	if n := disconnects.Load(); n != 1 {
+		t.Errorf("OnDisconnected called %d times, want 1", n)
+	}
+}
+
+func TestOnDisconnectedCalledOncePerDrop(t *testing.T) {
+	for _, autoReconnect := range []bool{false, true} {
+		t.Run(fmt.Sprintf("AutoReconnect=%v", autoReconnect), func(t *testing.T) {
+			server := newFakeServer(t)
+
+			var disconnects atomic.Int32
+			sdkConfig := testSDKConfig(server)
+			sdkConfig.OnDisconnected = func() { disconnects.Add(1) }
+
+			config := testConfig()
+			config.AutoReconnect = autoReconnect
+			config.ReconnectBackoff = time.Minute
+
+			conn, err := NewTunnelConn(config, sdkConfig, "8080")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fc := startTunnel(t, server, conn)
+			fc.conn.Close()
+			waitFor(t, func() bool { return disconnects.Load() == 1 })
+
+			// Stop while a reconnect is pending isn't another disconnect
+			conn.Stop()
+
+			if n := disconnects.Load(); n != 1 {
+				t.Errorf("OnDisconnected called %d times, want 1", n)
+			}
+
+			if stats := conn.Stats(); stats.UnexpectedDisconnects != 1 || stats.CleanDisconnects != 0 {
+				t.Errorf("%d unexpected and %d clean disconnects, want 1 and 0", stats.UnexpectedDisconnects, stats.CleanDisconnects)
+			}
+		})
+	}
+}
+
+func TestConnectContextCancelsHandshake(t *testing.T) {
+	// the server never answers the auth request
+	server := newFakeServerWith(t, func(fc *fakeConn) error {
+		if _, err := fc.readAuth(); err != nil {
+			return err
+		}
+
+		// hold the connection open until the client gives up
+		_, err := fc.read()
+		return err
+	})
+
+	conn, err := NewTunnelConn(testConfig(), testSDKConfig(server), "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := conn.ConnectContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ConnectContext = %v, want context.DeadlineExceeded", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("handshake aborted after %v", elapsed)
+	}
+
+	if status := conn.Status(); status != StatusDisconnected {
+		t.Errorf("status = %s, want %s", status, StatusDisconnected)
+	}
+}
+
+func TestMultiValueResponseHeaders(t *testing.T) {
+	forwarded := make(chan []string, 1)
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded <- r.Header.Values("X-Trace")
+
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+		http.SetCookie(w, &http.Cookie{Name: "theme", Value: "dark"})
+	}))
+
+	_, fc := newTestTunnel(t, nil, port)
+
+	resp := fc.request(TunnelMessage{
+		ID:           "1",
+		Method:       http.MethodGet,
+		Path:         "/",
+		Headers:      map[string]string{"X-Trace": "a"},
+		MultiHeaders: map[string][]string{"X-Trace": {"a", "b"}},
+	})
+
+	if values := <-forwarded; len(values) != 2 || values[0] != "a" || values[1] != "b" {
+		t.Errorf("backend got X-Trace %q, want both values", values)
+	}
+
+	cookies := resp.MultiHeaders["Set-Cookie"]
+	if len(cookies) != 2 || cookies[0] != "session=abc" || cookies[1] != "theme=dark" {
+		t.Errorf("Set-Cookie values = %q, want both cookies", cookies)
+	}
+
+	if first := resp.Headers["Set-Cookie"]; first != "session=abc" {
+		t.Errorf("Headers[Set-Cookie] = %q, want the first cookie for older servers", first)
+	}
+}
+
+func BenchmarkLocalConnectionReuse(b *testing.B) {
+	for _, keepAlive := range []bool{true, false} {
+		b.Run(fmt.Sprintf("keepalive=%v", keepAlive), func(b *testing.B) {
+			var dials atomic.Int64
+			backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "ok")
+			}))
+			backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					dials.Add(1)
+				}
+			}
+			backend.Start()
+			b.Cleanup(backend.Close)
+
+			config := testConfig()
+			if !keepAlive {
+				// what forwarding did before the client was shared
+				transport := http.DefaultTransport.(*http.Transport).Clone()
+				transport.DisableKeepAlives = true
+				config.HTTPClient = &http.Client{Transport: transport}
+			}
+
+			_, fc := newTestTunnel(b, config, urlPort(b, backend.URL))
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				fc.request(TunnelMessage{ID: fmt.Sprint(i), Method: http.MethodGet, Path: "/"})
+			}
+
+			b.StopTimer()
+			b.ReportMetric(float64(dials.Load())/float64(b.N), "dials/op")
+		})
+	}
+}
+
+func TestHTTPSLocalTargetNeedsInsecureSkipVerify(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secure")
+	}))
+	t.Cleanup(backend.Close)
+
+	for _, skipVerify := range []bool{false, true} {
+		config := testConfig()
+		config.LocalScheme = "https"
+		config.LocalHost = "127.0.0.1"
+		config.InsecureSkipVerify = skipVerify
+
+		_, fc := newTestTunnel(t, config, urlPort(t, backend.URL))
+
+		resp := fc.request(TunnelMessage{ID: "req-1", Method: http.MethodGet, Path: "/"})
+		ok := statusCode(t, resp) == http.StatusOK && resp.Body == "secure"
+		if ok != skipVerify {
+			t.Errorf("InsecureSkipVerify %v: status %d, body %q", skipVerify, statusCode(t, resp), resp.Body)
+		}
+	}
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	release := make(chan struct{})
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		io.WriteString(w, "done")
+	}))
+
+	conn, fc := newTestTunnel(t, nil, port)
+
+	if err := fc.send(TunnelMessage{Type: TunnelRequest, ID: "slow", Method: http.MethodGet, Path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return len(conn.InFlight()) == 1 })
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- conn.Shutdown(context.Background())
+	}()
+	waitFor(t, func() bool {
+		conn.drainMu.Lock()
+		defer conn.drainMu.Unlock()
+
+		return conn.draining
+	})
+
+	refused := fc.request(TunnelMessage{ID: "late", Method: http.MethodGet, Path: "/"})
+	if code := statusCode(t, refused); code != http.StatusServiceUnavailable {
+		t.Errorf("request during shutdown got %d, want 503", code)
+	}
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v before the in-flight request finished", err)
+	default:
+	}
+
+	close(release)
+
+	resp := fc.response("slow")
+	if code := statusCode(t, resp); code != http.StatusOK || resp.Body != "done" {
+		t.Errorf("in-flight request got %d %q, want it completed", code, resp.Body)
+	}
+
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("Shutdown = %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Shutdown didn't return after draining")
+	}
+
+	if conn.Status() != StatusDisconnected {
+		t.Errorf("status %v after Shutdown, want disconnected", conn.Status())
+	}
+}
+
+func TestShutdownAnswersRequestsWaitingForSlot(t *testing.T) {
+	release := make(chan struct{})
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		io.WriteString(w, "done")
+	}))
+
+	config := testConfig()
+	config.MaxConcurrentRequests = 1
+
+	conn, fc := newTestTunnel(t, config, port)
+
+	if err := fc.send(TunnelMessage{Type: TunnelRequest, ID: "slow", Method: http.MethodGet, Path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return len(conn.InFlight()) == 1 })
+
+	// queued behind the slow one for the only slot
+	if err := fc.send(TunnelMessage{Type: TunnelRequest, ID: "queued", Method: http.MethodGet, Path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- conn.Shutdown(context.Background())
+	}()
+
+	queued := fc.response("queued")
+	if code := statusCode(t, queued); code != http.StatusServiceUnavailable {
+		t.Errorf("request waiting for a slot got %d during shutdown, want 503", code)
+	}
+
+	close(release)
+
+	resp := fc.response("slow")
+	if code := statusCode(t, resp); code != http.StatusOK || resp.Body != "done" {
+		t.Errorf("in-flight request got %d %q, want it completed", code, resp.Body)
+	}
+
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("Shutdown = %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Shutdown didn't return after draining")
+	}
+}
+
+func TestStopAnswersRequestsWaitingForSlot(t *testing.T) {
+	release := make(chan struct{})
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	// registered after the backend's cleanup, so it runs before Close
+	t.Cleanup(func() { close(release) })
+
+	config := testConfig()
+	config.MaxConcurrentRequests = 1
+
+	conn, fc := newTestTunnel(t, config, port)
+
+	if err := fc.send(TunnelMessage{Type: TunnelRequest, ID: "slow", Method: http.MethodGet, Path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return len(conn.InFlight()) == 1 })
+
+	// queued behind the slow one for the only slot
+	if err := fc.send(TunnelMessage{Type: TunnelRequest, ID: "queued", Method: http.MethodGet, Path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a ping answered shows the queued request was dispatched
+	if err := fc.send(TunnelMessage{Type: TunnelPing, ID: "ping"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := fc.recv(); msg.Type != TunnelPong {
+		t.Fatalf("got message %d, want the pong", msg.Type)
+	}
+
+	conn.Stop()
+
+	queued := fc.response("queued")
+	if code := statusCode(t, queued); code != http.StatusServiceUnavailable {
+		t.Errorf("request waiting for a slot got %d on Stop, want 503", code)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	release := make(chan struct{})
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	// registered after the backend's cleanup, so it runs before Close
+	t.Cleanup(func() { close(release) })
+
+	conn, fc := newTestTunnel(t, nil, port)
+
+	if err := fc.send(TunnelMessage{Type: TunnelRequest, ID: "stuck", Method: http.MethodGet, Path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return len(conn.InFlight()) == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := conn.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown = %v, want context.DeadlineExceeded", err)
+	}
+
+	if conn.Status() != StatusDisconnected {
+		t.Errorf("status %v after Shutdown, want disconnected", conn.Status())
+	}
+}
+
+func TestMaxConcurrentRequestsBlocks(t *testing.T) {
+	const (
+		requests = 100
+		limit    = 5
+	)
+
+	var current, peak atomic.Int32
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := current.Add(1)
+		defer current.Add(-1)
+
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+
+		time.Sleep(2 * time.Millisecond)
+	}))
+
+	config := testConfig()
+	config.MaxConcurrentRequests = limit
+
+	_, fc := newTestTunnel(t, config, port)
+
+	for i := 0; i < requests; i++ {
+		msg := TunnelMessage{Type: TunnelRequest, ID: fmt.Sprint(i), Method: http.MethodGet, Path: "/"}
+		if err := fc.send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for id, resp := range fc.responses(requests) {
+		if code := statusCode(t, resp); code != http.StatusOK {
+			t.Errorf("request %s got %d, want 200", id, code)
+		}
+	}
+
+	if p := peak.Load(); p > limit {
+		t.Errorf("backend saw %d concurrent requests, want at most %d", p, limit)
+	}
+}
+
+func TestMaxConcurrentRequestsRejects(t *testing.T) {
+	const limit = 5
+
+	var arrived atomic.Int32
+	release := make(chan struct{})
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived.Add(1)
+		<-release
+	}))
+
+	config := testConfig()
+	config.MaxConcurrentRequests = limit
+	config.OverflowPolicy = OverflowReject
+
+	_, fc := newTestTunnel(t, config, port)
+
+	for i := 0; i < limit; i++ {
+		msg := TunnelMessage{Type: TunnelRequest, ID: fmt.Sprint(i), Method: http.MethodGet, Path: "/"}
+		if err := fc.send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool { return arrived.Load() == limit })
+
+	rejected := fc.request(TunnelMessage{ID: "over", Method: http.MethodGet, Path: "/"})
+	if code := statusCode(t, rejected); code != http.StatusServiceUnavailable {
+		t.Errorf("request over the limit got %d, want 503", code)
+	}
+
+	close(release)
+	fc.responses(limit)
+
+	accepted := fc.request(TunnelMessage{ID: "after", Method: http.MethodGet, Path: "/"})
+	if code := statusCode(t, accepted); code != http.StatusOK {
+		t.Errorf("request after the others completed got %d, want 200", code)
+	}
+}
+
+func TestLocalDialTimeoutIndependentOfRequestTimeout(t *testing.T) {
+	port := saturatedPort(t)
+
+	config := testConfig()
+	config.LocalDialTimeout = 200 * time.Millisecond
+	config.RequestTimeout = time.Minute
+
+	_, fc := newTestTunnel(t, config, port)
+
+	start := time.Now()
+	resp := fc.request(TunnelMessage{ID: "1", Method: http.MethodGet, Path: "/"})
+	elapsed := time.Since(start)
+
+	if code := statusCode(t, resp); code != http.StatusGatewayTimeout {
+		t.Errorf("request to a backend not accepting got %d, want 504", code)
+	}
+
+	if elapsed < config.LocalDialTimeout || elapsed > 2*time.Second {
+		t.Errorf("dial gave up after %v, want about %v", elapsed, config.LocalDialTimeout)
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	type seen struct{ path, auth, order string }
+
+	requests := make(chan seen, 1)
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- seen{r.URL.Path, r.Header.Get("Authorization"), r.Header.Get("X-Order")}
+		io.WriteString(w, "original")
+	}))
+
+	config := testConfig()
+	config.RequestInterceptors = []func(req *http.Request) (*http.Request, error){
+		func(req *http.Request) (*http.Request, error) {
+			if req.URL.Path == "/forbidden" {
+				return nil, errors.New("path not allowed")
+			}
+
+			req.Header.Del("Authorization")
+			req.Header.Set("X-Order", "first")
+			return nil, nil
+		},
+		func(req *http.Request) (*http.Request, error) {
+			rewritten := req.Clone(req.Context())
+			rewritten.URL.Path = strings.Replace(req.URL.Path, "/old", "/new", 1)
+			rewritten.Header.Set("X-Order", req.Header.Get("X-Order")+",second")
+			return rewritten, nil
+		},
+	}
+	config.ResponseInterceptors = []func(resp *http.Response) error{
+		func(resp *http.Response) error {
+			if resp.Request.URL.Path == "/new/broken" {
+				return errors.New("response not allowed")
+			}
+
+			resp.Body.Close()
+			resp.Body = io.NopCloser(strings.NewReader("intercepted"))
+			return nil
+		},
+	}
+
+	_, fc := newTestTunnel(t, config, port)
+
+	resp := fc.request(TunnelMessage{ID: "1", Method: http.MethodGet, Path: "/old/page", Headers: map[string]string{"Authorization": "Bearer secret"}})
+	if code := statusCode(t, resp); code != http.StatusOK || resp.Body != "intercepted" {
+		t.Errorf("intercepted request answered %d %q, want 200 intercepted", code, resp.Body)
+	}
+
+	if got, want := <-requests, (seen{"/new/page", "", "first,second"}); got != want {
+		t.Errorf("backend saw %+v, want %+v", got, want)
+	}
+
+	resp = fc.request(TunnelMessage{ID: "2", Method: http.MethodGet, Path: "/forbidden"})
+	if code := statusCode(t, resp); code != http.StatusInternalServerError || !strings.Contains(resp.Body, "path not allowed") {
+		t.Errorf("request interceptor error answered %d %q, want 500 with the error", code, resp.Body)
+	}
+
+	select {
+	case <-requests:
+		t.Error("request rejected by an interceptor reached the backend")
+	default:
+	}
+
+	resp = fc.request(TunnelMessage{ID: "3", Method: http.MethodGet, Path: "/old/broken"})
+	if code := statusCode(t, resp); code != http.StatusInternalServerError || !strings.Contains(resp.Body, "response not allowed") {
+		t.Errorf("response interceptor error answered %d %q, want 500 with the error", code, resp.Body)
+	}
+}
+
+func TestOnReconnectSwitchesLocalPort(t *testing.T) {
+	backend := func(name string) string {
+		return backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+	}
+	oldPort, newPort := backend("old"), backend("new")
+
+	server := newFakeServer(t)
+
+	var attempts atomic.Int32
+	sdkConfig := testSDKConfig(server)
+	sdkConfig.OnReconnect = func(attempt int, localPort string) string {
+		attempts.Add(1)
+		if localPort != oldPort {
+			t.Errorf("OnReconnect got port %s, want %s", localPort, oldPort)
+		}
+
+		return newPort
+	}
+
+	config := testConfig()
+	config.AutoReconnect = true
+	config.ReconnectBackoff = time.Millisecond
+
+	conn, err := NewTunnelConn(config, sdkConfig, oldPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fc := startTunnel(t, server, conn)
+
+	if resp := fc.request(TunnelMessage{ID: "before", Method: http.MethodGet, Path: "/"}); resp.Body != "old" {
+		t.Errorf("request before the reconnect reached %q, want old", resp.Body)
+	}
+
+	fc.conn.Close()
+	fc = server.accept()
+	waitFor(t, func() bool { return conn.Status() == StatusConnected })
+
+	if resp := fc.request(TunnelMessage{ID: "after", Method: http.MethodGet, Path: "/"}); resp.Body != "new" {
+		t.Errorf("request after the reconnect reached %q, want new", resp.Body)
+	}
+
+	if conn.LocalPort() != newPort || attempts.Load() != 1 {
+		t.Errorf("LocalPort = %s after %d OnReconnect calls, want %s after 1", conn.LocalPort(), attempts.Load(), newPort)
+	}
+}
+
+func TestDeleteWithBodyForwarded(t *testing.T) {
+	type received struct {
+		method        string
+		contentLength int64
+		body          string
+	}
+
+	requests := make(chan received, 1)
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- received{r.Method, r.ContentLength, string(body)}
+	}))
+
+	_, fc := newTestTunnel(t, nil, port)
+
+	body := `{"ids":[1,2,3]}`
+	resp := fc.request(TunnelMessage{
+		ID:      "1",
+		Method:  http.MethodDelete,
+		Path:    "/items",
+		Headers: map[string]string{"Content-Type": "application/json"},
+		Body:    body,
+	})
+	if code := statusCode(t, resp); code != http.StatusOK {
+		t.Fatalf("status %d, want 200", code)
+	}
+
+	if got, want := <-requests, (received{http.MethodDelete, int64(len(body)), body}); got != want {
+		t.Errorf("backend received %+v, want %+v", got, want)
+	}
+}
+
+func TestTunnelCreatedWithoutURLsRejected(t *testing.T) {
+	tests := map[string]map[string]string{
+		"missing Prod-URL": {HeaderLocalUrl: "http://tunnel-1.tunnel.test"},
+		"invalid Prod-URL": {HeaderLocalUrl: "http://tunnel-1.tunnel.test", HeaderProdUrl: "tunnel-1"},
+		"missing both":     nil,
+	}
+
+	for name, headers := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := newFakeServerWith(t, func(fc *fakeConn) error {
+				if _, err := fc.readAuth(); err != nil {
+					return err
+				}
+
+				fc.send(TunnelMessage{Type: TunnelCreated, ID: "tunnel-1", Headers: headers})
+
+				return errTestRefused
+			})
+
+			conn, err := NewTunnelConn(testConfig(), testSDKConfig(server), "8080")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Stop()
+
+			if err := conn.Connect(); err == nil || !strings.Contains(err.Error(), "tunnel created") {
+				t.Fatalf("Connect() = %v, want the tunnel URLs rejected", err)
+			}
+
+			if conn.Status() != StatusError {
+				t.Errorf("status %v, want %v", conn.Status(), StatusError)
+			}
+		})
+	}
+}
+
+func TestEarlyRequestPolicy(t *testing.T) {
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "early")
+	}))
+
+	tests := []struct {
+		name   string
+		policy EarlyRequestPolicy
+		grace  time.Duration
+		// delay is how long the server waits after the request before
+		// creating the tunnel
+		delay      time.Duration
+		wantStatus int
+	}{
+		{"buffered", EarlyRequestBuffer, 0, 100 * time.Millisecond, http.StatusOK},
+		{"within grace", EarlyRequestBuffer, time.Second, 0, http.StatusOK},
+		{"past grace", EarlyRequestBuffer, 50 * time.Millisecond, 100 * time.Millisecond, http.StatusServiceUnavailable},
+		{"rejected", EarlyRequestReject, 0, 0, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeServerWith(t, func(fc *fakeConn) error {
+				if _, err := fc.readAuth(); err != nil {
+					return err
+				}
+
+				if err := fc.send(TunnelMessage{Type: TunnelRequest, ID: "early-1", Method: http.MethodGet, Path: "/"}); err != nil {
+					return err
+				}
+
+				time.Sleep(tt.delay)
+
+				return fc.send(tunnelCreated("tunnel-1"))
+			})
+
+			config := testConfig()
+			config.EarlyRequestPolicy = tt.policy
+			config.EarlyRequestGrace = tt.grace
+
+			conn, err := NewTunnelConn(config, testSDKConfig(server), port)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fc := startTunnel(t, server, conn)
+
+			if status := statusCode(t, fc.response("early-1")); status != tt.wantStatus {
+				t.Errorf("early request answered %d, want %d", status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestStatusReadWhileConnectingAndStopping(t *testing.T) {
+	server := newFakeServer(t)
+
+	config := testConfig()
+	config.AutoReconnect = true
+	config.ReconnectBackoff = time.Millisecond
+
+	conn, err := NewTunnelConn(config, testSDKConfig(server), "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	polled := make(chan map[TunnelStatus]bool)
+	go func() {
+		seen := make(map[TunnelStatus]bool)
+		defer func() { polled <- seen }()
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			seen[conn.Status()] = true
+			conn.URLs()
+		}
+	}()
+
+	started := make(chan error, 1)
+	go func() {
+		started <- conn.Start()
+	}()
+
+	fc := server.accept()
+	waitFor(t, func() bool { return conn.Status() == StatusConnected })
+
+	fc.conn.Close()
+	server.accept()
+	waitFor(t, func() bool { return conn.Status() == StatusConnected })
+
+	conn.Stop()
+	<-started
+
+	close(done)
+	if seen := <-polled; !seen[StatusConnected] {
+		t.Errorf("polling saw statuses %v, want %v among them", seen, StatusConnected)
+	}
+
+	if conn.Status() != StatusDisconnected {
+		t.Errorf("status after Stop = %v, want %v", conn.Status(), StatusDisconnected)
+	}
+}
+
+func TestFixContentLength(t *testing.T) {
+	// a real server ending the body well before its Content-Length
+	port := rawBackendPort(t, func(w io.Writer) {
+		io.WriteString(w, "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nhello")
+	})
+
+	for _, fix := range []bool{true, false} {
+		t.Run(fmt.Sprintf("fix=%v", fix), func(t *testing.T) {
+			config := testConfig()
+			config.FixContentLength = fix
+
+			_, fc := newTestTunnel(t, config, port)
+
+			resp := fc.request(TunnelMessage{ID: "1", Method: http.MethodGet, Path: "/"})
+			if !fix {
+				if status := statusCode(t, resp); status != http.StatusInternalServerError {
+					t.Errorf("short body answered %d without the fix, want 500", status)
+				}
+
+				return
+			}
+
+			if status := statusCode(t, resp); status != http.StatusOK || resp.Body != "hello" {
+				t.Fatalf("answered %d %q, want 200 hello", status, resp.Body)
+			}
+
+			if got := resp.Headers["Content-Length"]; got != "5" {
+				t.Errorf("Content-Length = %q, want 5", got)
+			}
+		})
+	}
+}
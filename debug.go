@@ -0,0 +1,100 @@
+package sdk
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// maxRecentErrors bounds the errors kept for DebugSnapshot.
+const maxRecentErrors = 20
+
+type recentError struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+type errorHistory struct {
+	mu     sync.Mutex
+	errors []recentError
+}
+
+func (h *errorHistory) add(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.errors) == maxRecentErrors {
+		h.errors = append(h.errors[:0], h.errors[1:]...)
+	}
+
+	h.errors = append(h.errors, recentError{Time: time.Now(), Error: err.Error()})
+}
+
+func (h *errorHistory) list() []recentError {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]recentError(nil), h.errors...)
+}
+
+type debugSnapshot struct {
+	Time   time.Time    `json:"time"`
+	Status TunnelStatus `json:"status"`
+	Paused bool         `json:"paused"`
+
+	TunnelID string `json:"tunnel_id"`
+	LocalURL string `json:"local_url"`
+	ProdURL  string `json:"prod_url"`
+
+	Server          string `json:"server"`
+	TLS             bool   `json:"tls"`
+	ProtocolVersion string `json:"protocol_version,omitempty"`
+	RequestSigning  bool   `json:"request_signing"`
+
+	Config TunnelConfig `json:"config"`
+	Stats  Stats        `json:"stats"`
+
+	Reconnect struct {
+		Attempts  int       `json:"attempts"`
+		LastError string    `json:"last_error,omitempty"`
+		Since     time.Time `json:"since,omitempty"`
+	} `json:"reconnect"`
+
+	RecentErrors []recentError `json:"recent_errors"`
+}
+
+// DebugSnapshot serializes the tunnel's state as JSON for attaching to bug
+// reports. Secrets such as the auth token and signing secret are omitted.
+func (c *TunnelConn) DebugSnapshot() ([]byte, error) {
+	c.statusMu.RLock()
+	created := c.created
+	c.statusMu.RUnlock()
+
+	snapshot := debugSnapshot{
+		Time:   time.Now(),
+		Status: c.Status(),
+		Paused: c.Paused(),
+
+		TunnelID: c.TunnelID(),
+
+		Server:          c.sdkConfig.TunnelServer,
+		TLS:             c.sdkConfig.TLSConfig != nil,
+		ProtocolVersion: created.Headers[HeaderProtocolVersion],
+		RequestSigning:  c.sdkConfig.SigningSecret != "",
+
+		Config:       *c.config,
+		Stats:        c.Stats(),
+		RecentErrors: c.errHistory.list(),
+	}
+
+	snapshot.LocalURL, snapshot.ProdURL = c.URLs()
+
+	attempts, lastErr, since := c.ReconnectState()
+	snapshot.Reconnect.Attempts = attempts
+	snapshot.Reconnect.Since = since
+	if lastErr != nil {
+		snapshot.Reconnect.LastError = lastErr.Error()
+	}
+
+	return json.MarshalIndent(snapshot, "", "  ")
+}
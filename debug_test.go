@@ -0,0 +1,53 @@
+package sdk
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDebugSnapshot(t *testing.T) {
+	server := newFakeServer(t)
+	sdkConfig := testSDKConfig(server)
+	sdkConfig.AuthToken = "secret-auth-token"
+	sdkConfig.SigningSecret = "secret-signing-key"
+
+	conn, err := NewTunnelConn(testConfig(), sdkConfig, "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startTunnel(t, server, conn)
+	conn.onError(errors.New("backend went away"))
+
+	data, err := conn.DebugSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, secret := range []string{sdkConfig.AuthToken, sdkConfig.SigningSecret} {
+		if strings.Contains(string(data), secret) {
+			t.Fatalf("snapshot leaks %q:\n%s", secret, data)
+		}
+	}
+
+	var snapshot map[string]any
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, field := range []string{"time", "status", "tunnel_id", "prod_url", "server", "request_signing", "config", "stats", "reconnect", "recent_errors"} {
+		if _, ok := snapshot[field]; !ok {
+			t.Errorf("snapshot without %q:\n%s", field, data)
+		}
+	}
+
+	if snapshot["tunnel_id"] != conn.TunnelID() || snapshot["request_signing"] != true {
+		t.Errorf("snapshot tunnel_id = %v, request_signing = %v", snapshot["tunnel_id"], snapshot["request_signing"])
+	}
+
+	if !strings.Contains(string(data), "backend went away") {
+		t.Errorf("snapshot without the recent error:\n%s", data)
+	}
+}
@@ -7,9 +7,18 @@ var (
 	ErrEmptyToken       = errors.New("stored token is empty")
 	ErrNoTokenFilePath  = errors.New("token file path is not set")
 	ErrInvalidLocalPort = errors.New("invalid local port")
+	ErrInvalidLocalHost = errors.New("invalid local host")
+	ErrInvalidScheme    = errors.New("invalid local scheme")
 	ErrAuthFailure      = errors.New("authentication failed")
 	ErrConnectionClosed = errors.New("tunnel connection closed")
 	ErrTunnelTimeout    = errors.New("tunnel connection timed out")
 
-	ErrDuplicatePort = errors.New("duplicate port")
+	ErrUnsupportedProtocolVersion = errors.New("unsupported tunnel protocol version")
+	ErrInvalidSignature           = errors.New("invalid request signature")
+	ErrLocalBackendUnavailable    = errors.New("local backend unavailable")
+	ErrPullRequestsDisabled       = errors.New("pull requests are not enabled")
+	ErrAlreadyStarted             = errors.New("tunnel already started")
+
+	ErrDuplicatePort    = errors.New("duplicate port")
+	ErrArgumentsSwapped = errors.New("arguments appear to be swapped")
 )
@@ -12,5 +12,9 @@ func main() {
 		log.Fatalln(err)
 	}
 
-	client.Start("8080", nil)
+	if err := client.Start("8080", nil); err != nil {
+		log.Fatalln(err)
+	}
+
+	client.Wait()
 }
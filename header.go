@@ -0,0 +1,74 @@
+package sdk
+
+import (
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// canonicalHeaders rewrites header keys to their canonical MIME form so
+// lookups and overrides don't depend on the sender's casing. When several
+// keys collapse into one, the key already in canonical form wins, otherwise
+// the first one in sorted order.
+func canonicalHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	canonical := make(map[string]string, len(headers))
+	for _, key := range keys {
+		name := textproto.CanonicalMIMEHeaderKey(key)
+		if _, exists := canonical[name]; exists && key != name {
+			continue
+		}
+
+		canonical[name] = headers[key]
+	}
+
+	return canonical
+}
+
+// canonicalMultiHeaders is canonicalHeaders for repeated headers, merging
+// the values of keys differing only in case.
+func canonicalMultiHeaders(headers map[string][]string) map[string][]string {
+	if headers == nil {
+		return nil
+	}
+
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	canonical := make(map[string][]string, len(headers))
+	for _, key := range keys {
+		name := textproto.CanonicalMIMEHeaderKey(key)
+		canonical[name] = append(canonical[name], headers[key]...)
+	}
+
+	return canonical
+}
+
+// headerValue looks up key in a tunnel message's headers, ignoring case.
+func headerValue(headers map[string]string, key string) string {
+	if value, ok := headers[textproto.CanonicalMIMEHeaderKey(key)]; ok {
+		return value
+	}
+
+	for name, value := range headers {
+		if strings.EqualFold(name, key) {
+			return value
+		}
+	}
+
+	return ""
+}
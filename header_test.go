@@ -0,0 +1,70 @@
+package sdk
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestCanonicalHeaders(t *testing.T) {
+	got := canonicalHeaders(map[string]string{
+		"content-type":  "text/plain",
+		"Content-Type":  "application/json",
+		"x-request-id":  "1",
+		"X-REQUEST-ID":  "2",
+		"authorization": "Bearer x",
+	})
+
+	want := map[string]string{
+		"Content-Type":  "application/json",
+		"X-Request-Id":  "2",
+		"Authorization": "Bearer x",
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("canonicalHeaders = %v, want %v", got, want)
+	}
+
+	multi := canonicalMultiHeaders(map[string][]string{
+		"accept": {"text/html"},
+		"Accept": {"application/json"},
+	})
+
+	if want := map[string][]string{"Accept": {"application/json", "text/html"}}; !reflect.DeepEqual(multi, want) {
+		t.Errorf("canonicalMultiHeaders = %v, want %v", multi, want)
+	}
+
+	if value := headerValue(map[string]string{"x-http-method-override": "PUT"}, HeaderMethodOverride); value != "PUT" {
+		t.Errorf("headerValue ignoring case = %q, want PUT", value)
+	}
+}
+
+func TestMixedCaseHeadersForwardedOnce(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+	}))
+
+	_, fc := newTestTunnel(t, nil, port)
+
+	fc.request(TunnelMessage{
+		ID:     "1",
+		Method: http.MethodPost,
+		Path:   "/",
+		Headers: map[string]string{
+			"content-type": "text/plain",
+			"Content-Type": "application/json",
+			"x-api-key":    "secret",
+		},
+		Body: "{}",
+	})
+
+	got := <-headers
+	if values := got.Values("Content-Type"); len(values) != 1 || values[0] != "application/json" {
+		t.Errorf("backend got Content-Type %q, want only application/json", values)
+	}
+
+	if values := got.Values("X-Api-Key"); len(values) != 1 || values[0] != "secret" {
+		t.Errorf("backend got X-Api-Key %q, want secret", values)
+	}
+}
@@ -0,0 +1,38 @@
+package sdk
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync/atomic"
+)
+
+// DefaultMessageIDPrefix marks IDs of client-originated messages, keeping
+// them apart from request IDs assigned by the server.
+const DefaultMessageIDPrefix = "client-"
+
+// idGenerator hands out unique IDs for messages originated by the client:
+// the prefix, a random session component and a monotonic counter.
+type idGenerator struct {
+	prefix  string
+	session string
+	counter atomic.Uint64
+}
+
+func newIDGenerator(prefix string) *idGenerator {
+	if prefix == "" {
+		prefix = DefaultMessageIDPrefix
+	}
+
+	session := make([]byte, 4)
+	rand.Read(session)
+
+	return &idGenerator{
+		prefix:  prefix,
+		session: hex.EncodeToString(session),
+	}
+}
+
+func (g *idGenerator) next() string {
+	return g.prefix + g.session + "-" + strconv.FormatUint(g.counter.Add(1), 10)
+}
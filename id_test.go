@@ -0,0 +1,89 @@
+package sdk
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIDGeneratorUniqueUnderConcurrency(t *testing.T) {
+	const (
+		workers   = 8
+		perWorker = 1000
+	)
+
+	ids := newIDGenerator("")
+
+	var (
+		mu   sync.Mutex
+		seen = make(map[string]bool, workers*perWorker)
+		wg   sync.WaitGroup
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			generated := make([]string, 0, perWorker)
+			for j := 0; j < perWorker; j++ {
+				generated = append(generated, ids.next())
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			for _, id := range generated {
+				if seen[id] {
+					t.Errorf("ID %s generated twice", id)
+				}
+
+				seen[id] = true
+			}
+		}()
+	}
+	wg.Wait()
+
+	for id := range seen {
+		if !strings.HasPrefix(id, DefaultMessageIDPrefix) {
+			t.Fatalf("ID %s without the %q prefix, it could collide with server IDs", id, DefaultMessageIDPrefix)
+		}
+	}
+
+	// another tunnel starts another session
+	if a, b := newIDGenerator("").next(), newIDGenerator("").next(); a == b {
+		t.Errorf("two generators both started with %s", a)
+	}
+
+	if id := newIDGenerator("cli:").next(); !strings.HasPrefix(id, "cli:") {
+		t.Errorf("ID %s ignores the configured prefix", id)
+	}
+}
+
+func TestPingIDsUseMessagePrefix(t *testing.T) {
+	server := newFakeServer(t)
+	sdkConfig := testSDKConfig(server)
+	sdkConfig.MessageIDPrefix = "sdk-"
+
+	config := testConfig()
+	config.KeepaliveInterval = 10 * time.Millisecond
+
+	conn, err := NewTunnelConn(config, sdkConfig, "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fc := startTunnel(t, server, conn)
+
+	fc.conn.SetReadDeadline(time.Now().Add(testTimeout))
+
+	var ping TunnelMessage
+	if err := fc.decoder.Decode(&ping); err != nil {
+		t.Fatal(err)
+	}
+
+	if ping.Type != TunnelPing || !strings.HasPrefix(ping.ID, "sdk-") {
+		t.Errorf("got message %d with ID %q, want a ping with the sdk- prefix", ping.Type, ping.ID)
+	}
+}
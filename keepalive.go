@@ -0,0 +1,102 @@
+package sdk
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+func (c *TunnelConn) keepaliveInterval() time.Duration {
+	if c.config.KeepaliveInterval == 0 {
+		return DefaultKeepaliveInterval
+	}
+
+	return c.config.KeepaliveInterval
+}
+
+func (c *TunnelConn) keepaliveTimeout() time.Duration {
+	if c.config.KeepaliveTimeout <= 0 {
+		return DefaultKeepaliveTimeout
+	}
+
+	return c.config.KeepaliveTimeout
+}
+
+// keepalive pings the tunnel server every KeepaliveInterval until done is
+// closed. A ping arms a read deadline on conn, cleared by the next message
+// from the server, so a server that vanished without closing the
+// connection makes the read loop fail instead of blocking forever.
+func (c *TunnelConn) keepalive(conn net.Conn, done <-chan struct{}) {
+	interval := c.keepaliveInterval()
+	if interval < 0 {
+		return
+	}
+
+	c.awaitingPong.Store(false)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		c.armKeepalive(conn)
+
+		if err := c.send(TunnelMessage{Type: TunnelPing, ID: c.ids.next()}); err != nil {
+			if !errors.Is(err, ErrConnectionClosed) {
+				c.onError(errors.New("Error sending ping: " + err.Error()))
+			}
+
+			return
+		}
+	}
+}
+
+// armKeepalive sets the deadline for hearing from the server after the ping
+// about to be sent. Only the first unanswered ping sets it, later ones must
+// not push it back, and none does while the read loop is stalled on purpose.
+func (c *TunnelConn) armKeepalive(conn net.Conn) {
+	c.keepaliveMu.Lock()
+	defer c.keepaliveMu.Unlock()
+
+	if c.readsStalled == 0 && c.awaitingPong.CompareAndSwap(false, true) {
+		conn.SetReadDeadline(time.Now().Add(c.keepaliveTimeout()))
+	}
+}
+
+// messageReceived clears the keepalive deadline once the server is heard
+// from.
+func (c *TunnelConn) messageReceived() {
+	c.keepaliveMu.Lock()
+	defer c.keepaliveMu.Unlock()
+
+	c.clearKeepalive()
+}
+
+func (c *TunnelConn) clearKeepalive() {
+	if c.awaitingPong.CompareAndSwap(true, false) {
+		if link := c.currentLink(); link != nil {
+			link.conn.SetReadDeadline(time.Time{})
+		}
+	}
+}
+
+// stallReads suspends the keepalive deadline while the read loop stops
+// reading to push back on the server, since a pong can't arrive meanwhile.
+// The returned func resumes it.
+func (c *TunnelConn) stallReads() (resume func()) {
+	c.keepaliveMu.Lock()
+	c.readsStalled++
+	c.clearKeepalive()
+	c.keepaliveMu.Unlock()
+
+	return func() {
+		c.keepaliveMu.Lock()
+		c.readsStalled--
+		c.keepaliveMu.Unlock()
+	}
+}
@@ -0,0 +1,134 @@
+package sdk
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// answerPings replies to every keepalive ping of the client until the
+// connection is closed.
+func answerPings(fc *fakeConn) {
+	for {
+		var msg TunnelMessage
+		if err := fc.decoder.Decode(&msg); err != nil {
+			return
+		}
+
+		if msg.Type == TunnelPing {
+			fc.send(TunnelMessage{Type: TunnelPong, ID: msg.ID})
+		}
+	}
+}
+
+func TestKeepaliveAnsweredKeepsTunnel(t *testing.T) {
+	server := newFakeServer(t)
+
+	config := testConfig()
+	config.KeepaliveInterval = 10 * time.Millisecond
+	config.KeepaliveTimeout = 30 * time.Millisecond
+
+	conn, err := NewTunnelConn(config, testSDKConfig(server), "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fc := startTunnel(t, server, conn)
+	go answerPings(fc)
+
+	time.Sleep(10 * config.KeepaliveTimeout)
+
+	if conn.Status() != StatusConnected {
+		t.Errorf("status %v with pongs answered, want %v", conn.Status(), StatusConnected)
+	}
+}
+
+func TestKeepaliveUnansweredDropsTunnel(t *testing.T) {
+	server := newFakeServer(t)
+
+	errs := make(chan error, 16)
+	sdkConfig := testSDKConfig(server)
+	sdkConfig.OnError = func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+
+	config := testConfig()
+	config.AutoReconnect = true
+	config.ReconnectBackoff = time.Millisecond
+	config.KeepaliveInterval = 10 * time.Millisecond
+	config.KeepaliveTimeout = 30 * time.Millisecond
+
+	conn, err := NewTunnelConn(config, sdkConfig, "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server never answers and never closes the connection
+	startTunnel(t, server, conn)
+
+	start := time.Now()
+	fc := server.accept()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("reconnected after %v, want about %v", elapsed, config.KeepaliveInterval+config.KeepaliveTimeout)
+	}
+
+	for timedOut := false; !timedOut; {
+		select {
+		case err := <-errs:
+			timedOut = errors.Is(err, ErrTunnelTimeout)
+		case <-time.After(testTimeout):
+			t.Fatal("drop not reported as ErrTunnelTimeout")
+		}
+	}
+
+	go answerPings(fc)
+	waitFor(t, func() bool { return conn.Status() == StatusConnected })
+}
+
+func TestKeepaliveAnsweredWhileWaitingForSlot(t *testing.T) {
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	}))
+
+	config := testConfig()
+	config.MaxConcurrentRequests = 1
+	config.KeepaliveInterval = 10 * time.Millisecond
+	config.KeepaliveTimeout = 30 * time.Millisecond
+
+	conn, fc := newTestTunnel(t, config, port)
+
+	// the second request waits for the slot far longer than the keepalive
+	// timeout while the server keeps answering pings
+	for _, id := range []string{"1", "2"} {
+		msg := TunnelMessage{Type: TunnelRequest, ID: id, Method: http.MethodGet, Path: "/"}
+		if err := fc.send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for id, resp := range fc.responses(2) {
+		if code := statusCode(t, resp); code != http.StatusOK {
+			t.Errorf("request %s got %d, want 200", id, code)
+		}
+	}
+
+	if n := conn.Stats().UnexpectedDisconnects; n != 0 {
+		t.Errorf("%d unexpected disconnects with pongs answered, want 0", n)
+	}
+}
+
+func TestServerPingAnswered(t *testing.T) {
+	_, fc := newTestTunnel(t, nil, "8080")
+
+	if err := fc.send(TunnelMessage{Type: TunnelPing, ID: "server-ping"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := fc.recv(); msg.Type != TunnelPong || msg.ID != "server-ping" {
+		t.Errorf("got message %d %s, want a pong to server-ping", msg.Type, msg.ID)
+	}
+}
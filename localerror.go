@@ -0,0 +1,40 @@
+package sdk
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// localErrorReason classifies a failure to reach the local service so the
+// error response tells a self-signed certificate apart from a server that
+// is down.
+func localErrorReason(err error) string {
+	var (
+		certErr     *tls.CertificateVerificationError
+		unknownCA   x509.UnknownAuthorityError
+		hostnameErr x509.HostnameError
+		invalidCert x509.CertificateInvalidError
+		recordErr   tls.RecordHeaderError
+		alertErr    tls.AlertError
+		dnsErr      *net.DNSError
+	)
+
+	switch {
+	case errors.As(err, &certErr), errors.As(err, &unknownCA), errors.As(err, &hostnameErr), errors.As(err, &invalidCert):
+		return "TLS certificate of the local service is not trusted"
+	case errors.As(err, &recordErr), errors.As(err, &alertErr), strings.Contains(err.Error(), "tls: "),
+		// net/http reports a plain HTTP server answering the handshake this way
+		strings.Contains(err.Error(), "server gave HTTP response to HTTPS client"):
+		return "TLS handshake with the local service failed"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "Connection refused by the local service"
+	case errors.As(err, &dnsErr):
+		return "Could not resolve the local service host"
+	default:
+		return "Error connecting to the local service"
+	}
+}
@@ -0,0 +1,55 @@
+package sdk
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLocalErrorReasons(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tlsBackend := httptest.NewTLSServer(ok)
+	defer tlsBackend.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := urlPort(t, "http://"+listener.Addr().String())
+	listener.Close()
+
+	tests := []struct {
+		name   string
+		scheme string
+		host   string
+		port   string
+		reason string
+	}{
+		{"untrusted certificate", "https", "127.0.0.1", urlPort(t, tlsBackend.URL), "TLS certificate of the local service is not trusted"},
+		{"plain HTTP over TLS", "https", "127.0.0.1", backendPort(t, ok), "TLS handshake with the local service failed"},
+		{"refused", "http", "127.0.0.1", closedPort, "Connection refused by the local service"},
+		{"unresolvable host", "http", "tunnel-test.invalid", "80", "Could not resolve the local service host"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.LocalScheme = tt.scheme
+			config.LocalHost = tt.host
+
+			_, fc := newTestTunnel(t, config, tt.port)
+
+			resp := fc.request(TunnelMessage{ID: "1", Method: http.MethodGet, Path: "/"})
+			if status := statusCode(t, resp); status != http.StatusBadGateway {
+				t.Fatalf("status = %d, want 502", status)
+			}
+
+			if !strings.Contains(resp.Body, tt.reason) {
+				t.Errorf("body = %q, want %q", resp.Body, tt.reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package sdk
+
+import (
+	"slices"
+	"time"
+)
+
+// Metrics aggregates the traffic of all the running tunnels of a client.
+// Durations cover the most recent responses of each tunnel.
+type Metrics struct {
+	Tunnels int
+
+	RequestsTotal  uint64
+	ResponsesTotal uint64
+	ErrorsTotal    uint64
+
+	BytesIn  uint64
+	BytesOut uint64
+
+	AverageDuration time.Duration
+	P95Duration     time.Duration
+}
+
+// Metrics returns a snapshot of the traffic of the running tunnels. It is
+// safe to call while they forward requests.
+func (c *TunnelClient) Metrics() Metrics {
+	var (
+		metrics   Metrics
+		latencies []time.Duration
+	)
+
+	for _, conn := range c.tunnels.list() {
+		stats := conn.Stats()
+
+		metrics.Tunnels++
+		metrics.RequestsTotal += stats.Requests
+		metrics.ResponsesTotal += stats.Responses
+		metrics.ErrorsTotal += stats.Errors
+		metrics.BytesIn += stats.BytesIn
+		metrics.BytesOut += stats.BytesOut
+
+		latencies = append(latencies, conn.stats.recentLatencies()...)
+	}
+
+	if len(latencies) == 0 {
+		return metrics
+	}
+
+	var total time.Duration
+	for _, latency := range latencies {
+		total += latency
+	}
+
+	slices.Sort(latencies)
+
+	metrics.AverageDuration = total / time.Duration(len(latencies))
+	metrics.P95Duration = latencies[(len(latencies)*95+99)/100-1]
+
+	return metrics
+}
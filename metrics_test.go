@@ -0,0 +1,84 @@
+package sdk
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMetricsAggregateRunningTunnels(t *testing.T) {
+	const delay = 10 * time.Millisecond
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		io.WriteString(w, "hello")
+	})
+
+	server := newFakeServer(t)
+	client, err := NewTunnelClient(testSDKConfig(server), "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.StopAll()
+		client.Wait()
+	})
+
+	var fcs []*fakeConn
+	for i := 0; i < 2; i++ {
+		if err := client.Start(backendPort(t, handler), testConfig()); err != nil {
+			t.Fatal(err)
+		}
+
+		fcs = append(fcs, server.accept())
+	}
+
+	var wg sync.WaitGroup
+	for _, fc := range fcs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			fc.request(TunnelMessage{ID: "ok", Method: http.MethodPost, Path: "/", Body: "ping"})
+			fc.request(TunnelMessage{ID: "bad", Method: http.MethodGet, Path: "users"})
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// Metrics is read while the requests are forwarded
+	for forwarding := true; forwarding; {
+		select {
+		case <-done:
+			forwarding = false
+		default:
+			client.Metrics()
+		}
+	}
+
+	metrics := client.Metrics()
+	if metrics.Tunnels != 2 || metrics.RequestsTotal != 4 || metrics.ResponsesTotal != 2 || metrics.ErrorsTotal != 2 {
+		t.Errorf("metrics = %+v, want 2 tunnels, 4 requests, 2 responses and 2 errors", metrics)
+	}
+
+	if metrics.BytesIn != 8 || metrics.BytesOut != 10 {
+		t.Errorf("bytes in %d and out %d, want 8 and 10", metrics.BytesIn, metrics.BytesOut)
+	}
+
+	if metrics.AverageDuration < delay || metrics.P95Duration < metrics.AverageDuration {
+		t.Errorf("average %v and p95 %v, want at least %v and p95 above the average", metrics.AverageDuration, metrics.P95Duration, delay)
+	}
+
+	client.StopAll()
+	client.Wait()
+
+	if metrics := client.Metrics(); metrics != (Metrics{}) {
+		t.Errorf("metrics after StopAll = %+v, want zero", metrics)
+	}
+}
@@ -0,0 +1,34 @@
+package sdk
+
+import "strings"
+
+// rewritePath removes strip from the start of the request path and mounts
+// the rest under add, joining segments with a single slash. The query
+// string is kept as is.
+func rewritePath(requestPath, strip, add string) string {
+	if strip == "" && add == "" {
+		return requestPath
+	}
+
+	path, query, hasQuery := strings.Cut(requestPath, "?")
+
+	if strip = strings.TrimSuffix(strip, "/"); strip != "" {
+		if rest, ok := strings.CutPrefix(path, strip); ok && (rest == "" || strings.HasPrefix(rest, "/")) {
+			path = rest
+		}
+	}
+
+	if path == "" {
+		path = "/"
+	}
+
+	if add = strings.Trim(add, "/"); add != "" {
+		path = "/" + add + path
+	}
+
+	if hasQuery {
+		path += "?" + query
+	}
+
+	return path
+}
@@ -0,0 +1,50 @@
+package sdk
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRewritePath(t *testing.T) {
+	tests := []struct {
+		path, strip, add string
+		want             string
+	}{
+		{"/foo", "", "", "/foo"},
+		{"/foo", "", "/myapp", "/myapp/foo"},
+		{"/foo", "", "/myapp/", "/myapp/foo"},
+		{"/foo", "", "myapp", "/myapp/foo"},
+		{"/", "", "/myapp", "/myapp/"},
+		{"/foo/", "", "/myapp", "/myapp/foo/"},
+		{"/foo?a=1", "", "/myapp", "/myapp/foo?a=1"},
+		{"/api/foo", "/api", "", "/foo"},
+		{"/api/foo", "/api/", "", "/foo"},
+		{"/api", "/api", "", "/"},
+		{"/apix/foo", "/api", "", "/apix/foo"},
+		{"/api/foo?a=1", "/api", "/myapp/", "/myapp/foo?a=1"},
+	}
+
+	for _, tt := range tests {
+		if got := rewritePath(tt.path, tt.strip, tt.add); got != tt.want {
+			t.Errorf("rewritePath(%q, %q, %q) = %q, want %q", tt.path, tt.strip, tt.add, got, tt.want)
+		}
+	}
+}
+
+func TestAddPathPrefixForwarded(t *testing.T) {
+	paths := make(chan string, 1)
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.RequestURI()
+	}))
+
+	config := testConfig()
+	config.AddPathPrefix = "/myapp/"
+
+	_, fc := newTestTunnel(t, config, port)
+
+	fc.request(TunnelMessage{ID: "1", Method: http.MethodGet, Path: "/foo?page=2"})
+
+	if got := <-paths; got != "/myapp/foo?page=2" {
+		t.Errorf("backend got %q, want /myapp/foo?page=2", got)
+	}
+}
@@ -0,0 +1,144 @@
+package sdk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// prewarm dials PrewarmConnections TCP connections to each local backend
+// before the tunnel connects, so the first requests don't pay for dialing.
+// Nothing is sent on them: they're handed to the default client the next
+// time it dials that backend. Failures are reported but don't prevent the
+// tunnel from starting.
+func (c *TunnelConn) prewarm(ctx context.Context) {
+	if c.warm == nil || c.config.LocalHandler != nil {
+		return
+	}
+
+	hosts := []string{net.JoinHostPort(c.localHost(), c.LocalPort())}
+	if c.backends != nil {
+		hosts = hosts[:0]
+		for _, backend := range c.backends.backends {
+			hosts = append(hosts, net.JoinHostPort(backend.Host, backend.Port))
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, host := range hosts {
+		for range c.config.PrewarmConnections {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				if err := c.warm.prewarm(ctx, host); err != nil {
+					c.onError(fmt.Errorf("Error pre-warming a connection to %s: %w", host, err))
+				}
+			}()
+		}
+	}
+
+	wg.Wait()
+}
+
+// warmConns holds TCP connections dialed ahead of time by prewarm. The
+// default client dials through it, taking a pre-dialed connection to the
+// address when one is left and dialing otherwise.
+type warmConns struct {
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	mu     sync.Mutex
+	conns  map[string][]net.Conn
+	closed bool
+}
+
+// warmCheckTimeout is how long a pre-dialed connection is read from before
+// it's handed out, to find the ones the local service already closed.
+const warmCheckTimeout = time.Millisecond
+
+func (w *warmConns) prewarm(ctx context.Context, addr string) error {
+	conn, err := w.dial(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return conn.Close()
+	}
+
+	if w.conns == nil {
+		w.conns = make(map[string][]net.Conn)
+	}
+	w.conns[addr] = append(w.conns[addr], conn)
+
+	return nil
+}
+
+func (w *warmConns) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	for {
+		conn := w.take(addr)
+		if conn == nil {
+			break
+		}
+
+		if warmConnAlive(conn) {
+			return conn, nil
+		}
+		conn.Close()
+	}
+
+	return w.dial(ctx, network, addr)
+}
+
+func (w *warmConns) take(addr string) net.Conn {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	conns := w.conns[addr]
+	if len(conns) == 0 {
+		return nil
+	}
+
+	conn := conns[len(conns)-1]
+	w.conns[addr] = conns[:len(conns)-1]
+
+	return conn
+}
+
+// close closes the connections never handed out.
+func (w *warmConns) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+	for _, conns := range w.conns {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	w.conns = nil
+}
+
+// warmConnAlive reports whether nothing, not even EOF, arrived on a
+// pre-dialed connection, which the client is about to write the first
+// request on.
+func warmConnAlive(conn net.Conn) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(warmCheckTimeout)); err != nil {
+		return false
+	}
+
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+
+	return conn.SetReadDeadline(time.Time{}) == nil
+}
@@ -0,0 +1,48 @@
+package sdk
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPrewarmedConnectionsReused(t *testing.T) {
+	var dials, requests atomic.Int64
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		io.WriteString(w, "ok")
+	}))
+	backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			dials.Add(1)
+		}
+	}
+	backend.Start()
+	t.Cleanup(backend.Close)
+
+	config := testConfig()
+	config.PrewarmConnections = 2
+
+	_, fc := newTestTunnel(t, config, urlPort(t, backend.URL))
+
+	// Start pre-warms before connecting, so both are open by now
+	waitFor(t, func() bool { return dials.Load() == 2 })
+	if got := requests.Load(); got != 0 {
+		t.Fatalf("%d requests reached the backend while pre-warming, want none", got)
+	}
+
+	resp := fc.request(TunnelMessage{ID: "req-1", Method: http.MethodGet, Path: "/"})
+	if code := statusCode(t, resp); code != http.StatusOK {
+		t.Fatalf("status %d, want 200", code)
+	}
+
+	if got := dials.Load(); got != 2 {
+		t.Fatalf("%d connections after the first request, want it to reuse a pre-warmed one", got)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Fatalf("%d requests reached the backend, want only the forwarded one", got)
+	}
+}
@@ -0,0 +1,58 @@
+package sdk
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+)
+
+// Response is a reply supplied manually for a request obtained with
+// NextRequest.
+type Response struct {
+	StatusCode int
+	Headers    map[string]string
+	Body       string
+}
+
+// NextRequest blocks until the next request arrives through the tunnel and
+// returns it together with a function sending the response for it. It
+// requires TunnelConfig.PullRequests, which disables automatic forwarding
+// to the local service.
+func (c *TunnelConn) NextRequest(ctx context.Context) (TunnelMessage, func(resp Response), error) {
+	if c.pulled == nil {
+		return TunnelMessage{}, nil, ErrPullRequestsDisabled
+	}
+
+	select {
+	case <-ctx.Done():
+		return TunnelMessage{}, nil, ctx.Err()
+	case msg := <-c.pulled:
+		return msg, func(resp Response) {
+			c.sendResponse(msg.ID, resp)
+		}, nil
+	}
+}
+
+func (c *TunnelConn) sendResponse(requestID string, resp Response) {
+	if resp.StatusCode == 0 {
+		resp.StatusCode = http.StatusOK
+	}
+
+	headers := canonicalHeaders(resp.Headers)
+	if headers == nil {
+		headers = make(map[string]string, 1)
+	}
+
+	headers["X-Status-Code"] = strconv.Itoa(resp.StatusCode)
+
+	msg := TunnelMessage{
+		Type:    TunnelResponse,
+		ID:      requestID,
+		Headers: headers,
+		Body:    resp.Body,
+	}
+
+	if err := c.send(msg); err != nil {
+		c.reportSendError("response", err)
+	}
+}
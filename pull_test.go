@@ -0,0 +1,69 @@
+package sdk
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestNextRequestAnsweredManually(t *testing.T) {
+	config := testConfig()
+	config.PullRequests = true
+
+	// nothing listens on the port, the request must never be forwarded
+	conn, fc := newTestTunnel(t, config, closedPort(t))
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	pulled := make(chan TunnelMessage, 1)
+	go func() {
+		msg, respond, err := conn.NextRequest(ctx)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		pulled <- msg
+		respond(Response{
+			StatusCode: http.StatusTeapot,
+			Headers:    map[string]string{"content-type": "text/plain"},
+			Body:       "mocked",
+		})
+	}()
+
+	resp := fc.request(TunnelMessage{ID: "1", Method: http.MethodPost, Path: "/orders", Body: "order"})
+
+	if msg := <-pulled; msg.ID != "1" || msg.Method != http.MethodPost || msg.Path != "/orders" || msg.Body != "order" {
+		t.Errorf("NextRequest returned %+v", msg)
+	}
+
+	if status := statusCode(t, resp); status != http.StatusTeapot || resp.Body != "mocked" {
+		t.Errorf("got %d %q, want 418 \"mocked\"", status, resp.Body)
+	}
+
+	if contentType := resp.Headers["Content-Type"]; contentType != "text/plain" {
+		t.Errorf("Content-Type = %q, want text/plain", contentType)
+	}
+}
+
+func TestNextRequestHonorsContext(t *testing.T) {
+	conn, _ := newTestTunnel(t, nil, "8080")
+
+	if _, _, err := conn.NextRequest(context.Background()); !errors.Is(err, ErrPullRequestsDisabled) {
+		t.Errorf("NextRequest without PullRequests = %v, want ErrPullRequestsDisabled", err)
+	}
+
+	config := testConfig()
+	config.PullRequests = true
+
+	conn, _ = newTestTunnel(t, config, "8080")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, _, err := conn.NextRequest(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("NextRequest with a cancelled context = %v, want context.Canceled", err)
+	}
+}
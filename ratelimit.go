@@ -0,0 +1,94 @@
+package sdk
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRateLimitedIPs bounds how many per-IP limiters are kept, the least
+// recently seen IP is forgotten first.
+const maxRateLimitedIPs = 4096
+
+type ipBucket struct {
+	ip     string
+	tokens float64
+	last   time.Time
+}
+
+// ipRateLimiter is a token bucket per client IP, refilled at rate tokens per
+// second up to burst.
+type ipRateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	order   *list.List
+	buckets map[string]*list.Element
+}
+
+func newIPRateLimiter(rate float64, burst int) *ipRateLimiter {
+	if burst <= 0 {
+		burst = max(1, int(rate))
+	}
+
+	return &ipRateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		order:   list.New(),
+		buckets: make(map[string]*list.Element),
+	}
+}
+
+func (l *ipRateLimiter) allow(ip string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	element, ok := l.buckets[ip]
+	if !ok {
+		if l.order.Len() >= maxRateLimitedIPs {
+			oldest := l.order.Back()
+			l.order.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*ipBucket).ip)
+		}
+
+		element = l.order.PushFront(&ipBucket{ip: ip, tokens: l.burst, last: now})
+		l.buckets[ip] = element
+	} else {
+		l.order.MoveToFront(element)
+	}
+
+	bucket := element.Value.(*ipBucket)
+	bucket.tokens = min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	bucket.tokens--
+	return true
+}
+
+// clientIP is the address the request came from as forwarded by the tunnel
+// server, empty when unknown. It is the last X-Forwarded-For hop, the one
+// appended by the server: earlier ones are sent by the public client and
+// could be anything.
+func clientIP(headers map[string]string) string {
+	if ip := lastForwardedHost(headerValue(headers, "X-Forwarded-For")); ip != "" {
+		return ip
+	}
+
+	return headerValue(headers, "X-Real-Ip")
+}
+
+func lastForwardedHost(value string) string {
+	hosts := strings.Split(value, ",")
+	for i := len(hosts) - 1; i >= 0; i-- {
+		if host := strings.TrimSpace(hosts[i]); host != "" {
+			return host
+		}
+	}
+
+	return ""
+}
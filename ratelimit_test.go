@@ -0,0 +1,82 @@
+package sdk
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestIPRateLimiterBuckets(t *testing.T) {
+	limiter := newIPRateLimiter(1, 2)
+	now := time.Now()
+
+	for i, want := range []bool{true, true, false} {
+		if got := limiter.allow("10.0.0.1", now); got != want {
+			t.Errorf("request %d from 10.0.0.1 allowed = %v, want %v", i, got, want)
+		}
+	}
+
+	if !limiter.allow("10.0.0.2", now) {
+		t.Error("10.0.0.2 throttled by the traffic of 10.0.0.1")
+	}
+
+	if !limiter.allow("10.0.0.1", now.Add(time.Second)) {
+		t.Error("10.0.0.1 still throttled after its bucket refilled")
+	}
+}
+
+func TestClientIPUsesLastForwardedHop(t *testing.T) {
+	tests := []struct {
+		headers map[string]string
+		want    string
+	}{
+		{map[string]string{"X-Forwarded-For": "203.0.113.7"}, "203.0.113.7"},
+		{map[string]string{"X-Forwarded-For": "1.2.3.4, 203.0.113.7"}, "203.0.113.7"},
+		{map[string]string{"x-forwarded-for": "1.2.3.4,203.0.113.7, "}, "203.0.113.7"},
+		{map[string]string{"X-Real-Ip": "198.51.100.1"}, "198.51.100.1"},
+		{nil, ""},
+	}
+
+	for _, tt := range tests {
+		if got := clientIP(tt.headers); got != tt.want {
+			t.Errorf("clientIP(%v) = %q, want %q", tt.headers, got, tt.want)
+		}
+	}
+}
+
+func TestPerIPRateLimit(t *testing.T) {
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	config := testConfig()
+	config.PerIPRequestsPerSecond = 0.001
+	config.PerIPBurst = 2
+
+	_, fc := newTestTunnel(t, config, port)
+
+	request := func(id, forwardedFor string) int {
+		resp := fc.request(TunnelMessage{
+			ID:      id,
+			Method:  http.MethodGet,
+			Path:    "/",
+			Headers: map[string]string{"X-Forwarded-For": forwardedFor},
+		})
+
+		return statusCode(t, resp)
+	}
+
+	for i := 0; i < 2; i++ {
+		if status := request(fmt.Sprint("a", i), "203.0.113.7"); status != http.StatusOK {
+			t.Fatalf("request %d within the burst answered %d", i, status)
+		}
+	}
+
+	// a spoofed first hop doesn't give the client a fresh bucket
+	if status := request("a-spoofed", "192.0.2.99, 203.0.113.7"); status != http.StatusTooManyRequests {
+		t.Errorf("throttled client answered %d, want 429", status)
+	}
+
+	if status := request("b", "198.51.100.1"); status != http.StatusOK {
+		t.Errorf("another client answered %d while the first is throttled, want 200", status)
+	}
+}
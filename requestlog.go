@@ -0,0 +1,161 @@
+package sdk
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRequestLogMaxSize = 10 * 1024 * 1024
+
+	requestLogQueueSize = 256
+)
+
+type requestLogEntry struct {
+	Time     time.Time `json:"time"`
+	ID       string    `json:"id"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Status   string    `json:"status"`
+	Duration string    `json:"duration"`
+	BytesIn  int       `json:"bytes_in"`
+	BytesOut int       `json:"bytes_out"`
+}
+
+// requestLogger appends one JSON line per forwarded request to a file,
+// rotating it to path.1 once it grows past maxSize. Entries are written by a
+// background goroutine and dropped when the queue is full, so logging never
+// blocks forwarding.
+type requestLogger struct {
+	path    string
+	maxSize int64
+
+	file *os.File
+	size int64
+
+	entries chan requestLogEntry
+	done    chan struct{}
+	wg      sync.WaitGroup
+	once    sync.Once
+}
+
+func newRequestLogger(path string, maxSize int64) (*requestLogger, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultRequestLogMaxSize
+	}
+
+	l := &requestLogger{
+		path:    path,
+		maxSize: maxSize,
+		entries: make(chan requestLogEntry, requestLogQueueSize),
+		done:    make(chan struct{}),
+	}
+
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	l.wg.Add(1)
+	go l.run()
+
+	return l, nil
+}
+
+func (l *requestLogger) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file = file
+	l.size = info.Size()
+
+	return nil
+}
+
+func (l *requestLogger) log(entry requestLogEntry) {
+	if l == nil {
+		return
+	}
+
+	select {
+	case <-l.done:
+	case l.entries <- entry:
+	default:
+	}
+}
+
+func (l *requestLogger) run() {
+	defer l.wg.Done()
+
+	for {
+		select {
+		case entry := <-l.entries:
+			l.write(entry)
+		case <-l.done:
+			for {
+				select {
+				case entry := <-l.entries:
+					l.write(entry)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (l *requestLogger) write(entry requestLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	line = append(line, '\n')
+
+	if l.size+int64(len(line)) > l.maxSize && l.size > 0 {
+		l.rotate()
+	}
+
+	if l.file == nil {
+		return
+	}
+
+	n, _ := l.file.Write(line)
+	l.size += int64(n)
+}
+
+func (l *requestLogger) rotate() {
+	l.file.Close()
+	l.file = nil
+
+	os.Rename(l.path, l.path+".1")
+	l.open()
+}
+
+// Close flushes queued entries and closes the log file.
+func (l *requestLogger) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		l.wg.Wait()
+
+		if l.file != nil {
+			err = l.file.Close()
+		}
+	})
+
+	return err
+}
@@ -0,0 +1,108 @@
+package sdk
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readLogEntries(t *testing.T, path string) []requestLogEntry {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var entries []requestLogEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry requestLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid log line %q: %v", scanner.Text(), err)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func testLogEntry(i int) requestLogEntry {
+	return requestLogEntry{
+		Time:     time.Now(),
+		ID:       fmt.Sprint("req-", i),
+		Method:   "GET",
+		Path:     "/",
+		Status:   "200",
+		Duration: "1ms",
+	}
+}
+
+func TestRequestLogWritesEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.log")
+
+	l, err := newRequestLogger(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		l.log(testLogEntry(i))
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readLogEntries(t, path)
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(entries))
+	}
+
+	for i, entry := range entries {
+		if entry.ID != fmt.Sprint("req-", i) || entry.Status != "200" {
+			t.Errorf("entry %d = %+v", i, entry)
+		}
+	}
+}
+
+func TestRequestLogRotatesPastMaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.log")
+	const maxSize = 512
+
+	l, err := newRequestLogger(path, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		l.log(testLogEntry(i))
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{path, path + ".1"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("%s: %v", filepath.Base(name), err)
+		}
+
+		if info.Size() == 0 || info.Size() > maxSize {
+			t.Errorf("%s is %d bytes, want 1 to %d", filepath.Base(name), info.Size(), maxSize)
+		}
+	}
+
+	// the current file holds the latest entries
+	entries := readLogEntries(t, path)
+	if last := entries[len(entries)-1]; last.ID != "req-9" {
+		t.Errorf("last entry = %s, want req-9", last.ID)
+	}
+}
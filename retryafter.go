@@ -0,0 +1,66 @@
+package sdk
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRetryAfter caps how long a Retry-After from the tunnel server can hold
+// back reconnecting.
+const maxRetryAfter = 10 * time.Minute
+
+// retryAfterDelay turns a Retry-After value into a delay. An HTTP-date is
+// measured against the server's Date when given, so a skewed client clock
+// doesn't stretch or cancel the wait. The delay is clamped to
+// [0, maxRetryAfter]; ok is false when value can't be parsed.
+func retryAfterDelay(value, serverDate string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else {
+		retryAt, err := http.ParseTime(value)
+		if err != nil {
+			return 0, false
+		}
+
+		reference := now
+		if date, err := http.ParseTime(serverDate); err == nil {
+			reference = date
+		}
+
+		delay = retryAt.Sub(reference)
+	}
+
+	return min(max(delay, 0), maxRetryAfter), true
+}
+
+// recordRetryAfter keeps the Retry-After sent by the tunnel server with a
+// failure, honored by the next reconnect attempt.
+func (c *TunnelConn) recordRetryAfter(headers map[string]string) {
+	delay, ok := retryAfterDelay(headerValue(headers, "Retry-After"), headerValue(headers, "Date"), time.Now())
+	if !ok {
+		return
+	}
+
+	c.reconnectMu.Lock()
+	c.retryAfter = delay
+	c.reconnectMu.Unlock()
+}
+
+// takeRetryAfter returns the recorded Retry-After delay and clears it.
+func (c *TunnelConn) takeRetryAfter() time.Duration {
+	c.reconnectMu.Lock()
+	defer c.reconnectMu.Unlock()
+
+	delay := c.retryAfter
+	c.retryAfter = 0
+
+	return delay
+}
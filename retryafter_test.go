@@ -0,0 +1,45 @@
+package sdk
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryAfterDelayCorrectsClockSkew(t *testing.T) {
+	// the client clock runs an hour ahead of the server's
+	server := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	client := server.Add(time.Hour)
+
+	date := func(t time.Time) string {
+		return t.Format(http.TimeFormat)
+	}
+
+	tests := []struct {
+		name       string
+		value      string
+		serverDate string
+		want       time.Duration
+		wantOK     bool
+	}{
+		{"seconds", "30", "", 30 * time.Second, true},
+		{"date against server Date", date(server.Add(time.Minute)), date(server), time.Minute, true},
+		{"date without server Date", date(client.Add(time.Minute)), "", time.Minute, true},
+		{"date in the past", date(server.Add(-time.Minute)), date(server), 0, true},
+		{"far future date", date(server.Add(24 * time.Hour)), date(server), maxRetryAfter, true},
+		{"negative seconds", "-5", "", 0, true},
+		{"huge seconds", "86400", "", maxRetryAfter, true},
+		{"invalid server Date", date(client.Add(time.Minute)), "yesterday", time.Minute, true},
+		{"empty", "", date(server), 0, false},
+		{"garbage", "soon", date(server), 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := retryAfterDelay(tt.value, tt.serverDate, client)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("retryAfterDelay(%q, %q) = %v, %v, want %v, %v", tt.value, tt.serverDate, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
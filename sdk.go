@@ -1,28 +1,133 @@
 package sdk
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 )
 
 type SDKConfig struct {
 	TunnelServer string
 	AuthToken    string
 
+	// Authenticator customizes the handshake. Nil authenticates with
+	// AuthToken through a TokenAuthenticator.
+	Authenticator Authenticator
+
+	// TLSConfig enables TLS on the control connection when set.
+	TLSConfig *tls.Config
+	// MinTLSVersion is the lowest TLS version accepted on the control
+	// connection. Zero defaults to TLS 1.2. A higher TLSConfig.MinVersion
+	// is kept.
+	MinTLSVersion uint16
+
+	// Control is passed to net.Dialer when dialing the control connection,
+	// allowing socket options such as SO_REUSEADDR to be set.
+	Control func(network, address string, c syscall.RawConn) error
+
+	// ProtocolVersion is sent to the server during the handshake. Zero uses
+	// the SDK's ProtocolVersion.
+	ProtocolVersion int
+
+	// SigningSecret enables HMAC-SHA256 verification of incoming requests
+	// and upload frames. Those without a valid X-Tunnel-Signature, or whose
+	// X-Tunnel-Timestamp is more than 5 minutes off, are rejected.
+	SigningSecret string
+
+	// WebhookURL receives a JSON POST for each lifecycle event and error,
+	// one at a time and in order, lifecycle events first when both wait.
+	WebhookURL string
+
+	// MessageIDPrefix starts the IDs of messages originated by the client,
+	// such as pings. Empty uses DefaultMessageIDPrefix.
+	MessageIDPrefix string
+
+	// The On* callbacks are read once, by NewTunnelClient or NewTunnelConn,
+	// so they must be set before calling it. Assigning them afterwards has
+	// no effect; use UpdateCallbacks to change them on a running client.
 	OnAuth           func(token string)
 	OnConnected      func(localPort, localUrl, prodUrl, tunnelId string)
 	OnDisconnected   func()
 	OnError          func(err error)
 	OnRequest        func(msg TunnelMessage)
 	OnSedingResponse func(msg TunnelMessage, resp *http.Response, body []byte)
-	Logger           *log.Logger
+	// OnMessageAfterStop, if set, receives messages still buffered when the
+	// tunnel is stopped. They are discarded otherwise.
+	OnMessageAfterStop func(msg TunnelMessage)
+	// OnBeforeAuth, if set, sees the token right before it is sent and
+	// returns the one to send. An error aborts the connect.
+	OnBeforeAuth func(token string) (string, error)
+	// OnShutdown, if set, receives a summary of the tunnel when it is
+	// stopped. The summary is also written to Logger when set.
+	OnShutdown func(report ShutdownReport)
+	// OnReconnect, if set, is called before each reconnect attempt with the
+	// current local port and returns the one to forward to from then on,
+	// for a local service that moved. Empty keeps the current port.
+	OnReconnect func(attempt int, localPort string) string
+	Logger      *log.Logger
+
+	// callbacks holds the On* callbacks read by running tunnels, see
+	// UpdateCallbacks
+	callbacks *callbackStore
 }
 
 type TunnelClient struct {
-	conn   []*TunnelConn
-	config *SDKConfig
+	tunnels *tunnelSet
+	config  *SDKConfig
+}
+
+// tunnelSet tracks the running tunnels of a client. It is shared by copies
+// of the TunnelClient.
+type tunnelSet struct {
+	mu    sync.Mutex
+	conns []*TunnelConn
+
+	// wg counts the tunnels until they are removed
+	wg sync.WaitGroup
+}
+
+// add registers conn unless a tunnel for the same local port is running.
+func (s *tunnelSet) add(conn *TunnelConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.conns {
+		if c.LocalPort() == conn.LocalPort() {
+			return false
+		}
+	}
+
+	s.conns = append(s.conns, conn)
+	s.wg.Add(1)
+
+	return true
+}
+
+func (s *tunnelSet) remove(conn *TunnelConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conns = slices.DeleteFunc(s.conns, func(c *TunnelConn) bool {
+		return c == conn
+	})
+	s.wg.Done()
+}
+
+func (s *tunnelSet) list() []*TunnelConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.conns)
 }
 
 var DefaultSDKConfig = SDKConfig{
@@ -31,8 +136,14 @@ var DefaultSDKConfig = SDKConfig{
 }
 
 func NewTunnelClient(config *SDKConfig, token string) (TunnelClient, error) {
+	if err := validateToken(token); err != nil {
+		return TunnelClient{}, err
+	}
+
 	if config == nil {
-		config = &DefaultSDKConfig
+		// copy the defaults, the callbacks set below must not leak into them
+		defaults := DefaultSDKConfig
+		config = &defaults
 	}
 
 	if config.OnConnected == nil {
@@ -75,19 +186,28 @@ func NewTunnelClient(config *SDKConfig, token string) (TunnelClient, error) {
 	}
 
 	config.AuthToken = token
+	config.initCallbacks()
 
 	return TunnelClient{
-		conn:   make([]*TunnelConn, 0),
-		config: config,
+		tunnels: &tunnelSet{},
+		config:  config,
 	}, nil
 }
 
+// Start opens a tunnel to the local port in the background and returns
+// right away, or with ErrLocalBackendUnavailable when ProbeLocalOnStart finds
+// nothing listening. Several tunnels can run at once on different ports; Wait
+// blocks until they all end and StopAll stops them.
 func (c *TunnelClient) Start(port string, config *TunnelConfig) error {
-	// for _, conn := range c.conn {
-	// 	if conn.LocalPort == port {
-	// 		return ErrDuplicatePort
-	// 	}
-	// }
+	return c.StartContext(context.Background(), port, config)
+}
+
+// StartContext starts a tunnel like Start, with ctx bounding the dial, the
+// handshake and reconnect attempts.
+func (c *TunnelClient) StartContext(ctx context.Context, port string, config *TunnelConfig) error {
+	if err := validateLocalPort(port); err != nil {
+		return err
+	}
 
 	if config == nil {
 		config = &DefaultTunnelConfig
@@ -99,10 +219,106 @@ func (c *TunnelClient) Start(port string, config *TunnelConfig) error {
 		return err
 	}
 
-	conn.Start()
+	// probe here rather than only in the goroutine, so Start still fails
+	// fast with ErrLocalBackendUnavailable
+	if config.ProbeLocalOnStart {
+		if err := conn.probeLocal(); err != nil {
+			conn.onError(err)
+			return err
+		}
+	}
+
+	if !c.tunnels.add(conn) {
+		return fmt.Errorf("%w: %s is already tunneled", ErrDuplicatePort, port)
+	}
+
+	go func() {
+		defer c.tunnels.remove(conn)
+		defer conn.Stop()
+
+		// already probed above
+		if err := conn.start(ctx, false); err != nil {
+			conn.onError(fmt.Errorf("Tunnel for port %s ended: %w", port, err))
+		}
+	}()
+
+	return nil
+}
+
+// StopAll stops every tunnel of the client.
+func (c *TunnelClient) StopAll() {
+	for _, conn := range c.tunnels.list() {
+		conn.Stop()
+	}
+}
+
+// Wait blocks until every tunnel of the client has ended.
+func (c *TunnelClient) Wait() {
+	c.tunnels.wg.Wait()
+}
+
+// Tunnels returns the running tunnels of the client, giving access to
+// their status, URLs and other details.
+func (c *TunnelClient) Tunnels() []*TunnelConn {
+	return c.tunnels.list()
+}
+
+// Tunnel returns the running tunnel forwarding to localPort, or nil.
+func (c *TunnelClient) Tunnel(localPort string) *TunnelConn {
+	for _, conn := range c.tunnels.list() {
+		if conn.LocalPort() == localPort {
+			return conn
+		}
+	}
+
+	return nil
+}
+
+// validateToken catches the common mistake of passing the local port or the
+// server address where the auth token belongs.
+func validateToken(token string) error {
+	if _, err := strconv.Atoi(token); err == nil {
+		return fmt.Errorf("%w: token %q looks like a port, pass the auth token to NewTunnelClient and the local port to Start", ErrArgumentsSwapped, token)
+	}
+
+	if _, port, err := net.SplitHostPort(token); err == nil {
+		if _, err := strconv.Atoi(port); err == nil {
+			return fmt.Errorf("%w: token %q looks like a host:port address, set SDKConfig.TunnelServer to change the server", ErrArgumentsSwapped, token)
+		}
+	}
+
+	return nil
+}
+
+func validateLocalHost(host string) error {
+	if host == "" || net.ParseIP(host) != nil {
+		return nil
+	}
+
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("%w: %q", ErrInvalidLocalHost, host)
+		}
 
-	defer conn.Stop()
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return fmt.Errorf("%w: %q, expected a host name or IP address without scheme or port", ErrInvalidLocalHost, host)
+			}
+		}
+	}
 
 	return nil
+}
+
+func validateLocalPort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err == nil && n > 0 && n <= 65535 {
+		return nil
+	}
+
+	if err != nil && len(port) >= 16 {
+		return fmt.Errorf("%w: %q looks like an auth token, pass the token to NewTunnelClient and the local port to Start", ErrArgumentsSwapped, port)
+	}
 
+	return fmt.Errorf("%w: %q", ErrInvalidLocalPort, port)
 }
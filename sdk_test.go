@@ -0,0 +1,438 @@
+package sdk
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSwappedArgumentsAreReported(t *testing.T) {
+	for _, token := range []string{"8080", "tunnel.example.com:9000"} {
+		if _, err := NewTunnelClient(nil, token); !errors.Is(err, ErrArgumentsSwapped) {
+			t.Errorf("NewTunnelClient(nil, %q) = %v, want ErrArgumentsSwapped", token, err)
+		}
+	}
+
+	client, err := NewTunnelClient(nil, "a1b2c3d4e5f6a7b8c9d0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Start("a1b2c3d4e5f6a7b8c9d0", nil); !errors.Is(err, ErrArgumentsSwapped) {
+		t.Errorf("Start(token) = %v, want ErrArgumentsSwapped", err)
+	}
+
+	if err := client.Start("http", nil); !errors.Is(err, ErrInvalidLocalPort) {
+		t.Errorf("Start(\"http\") = %v, want ErrInvalidLocalPort", err)
+	}
+}
+
+// closedPort returns a loopback port nothing listens on.
+func closedPort(t testing.TB) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := urlPort(t, "http://"+listener.Addr().String())
+	listener.Close()
+
+	return port
+}
+
+func TestProbeLocalOnStart(t *testing.T) {
+	port := closedPort(t)
+
+	for _, probe := range []bool{true, false} {
+		t.Run(fmt.Sprintf("probe=%v", probe), func(t *testing.T) {
+			server := newFakeServer(t)
+
+			client, err := NewTunnelClient(testSDKConfig(server), "token")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				client.StopAll()
+				client.Wait()
+			})
+
+			config := testConfig()
+			config.ProbeLocalOnStart = probe
+
+			start := time.Now()
+			err = client.Start(port, config)
+
+			if probe {
+				if !errors.Is(err, ErrLocalBackendUnavailable) || !strings.Contains(err.Error(), port) {
+					t.Fatalf("Start = %v, want ErrLocalBackendUnavailable naming port %s", err, port)
+				}
+
+				if elapsed := time.Since(start); elapsed > time.Second {
+					t.Errorf("Start took %v to fail", elapsed)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Start = %v, want the failure deferred to request time", err)
+			}
+
+			fc := server.accept()
+			resp := fc.request(TunnelMessage{ID: "1", Method: http.MethodGet, Path: "/"})
+			if status := statusCode(t, resp); status != http.StatusBadGateway {
+				t.Errorf("request to closed port answered %d, want 502", status)
+			}
+		})
+	}
+}
+
+func TestClientProbesLocalOnce(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var probes atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			probes.Add(1)
+			conn.Close()
+		}
+	}()
+
+	server := newFakeServer(t)
+	client, err := NewTunnelClient(testSDKConfig(server), "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.StopAll()
+		client.Wait()
+	})
+
+	config := testConfig()
+	config.ProbeLocalOnStart = true
+
+	if err := client.Start(urlPort(t, "http://"+listener.Addr().String()), config); err != nil {
+		t.Fatal(err)
+	}
+
+	// connected, so past any probe of the tunnel itself
+	server.accept()
+	waitFor(t, func() bool { return probes.Load() > 0 })
+	time.Sleep(50 * time.Millisecond)
+
+	if n := probes.Load(); n != 1 {
+		t.Errorf("local service probed %d times, want once", n)
+	}
+}
+
+// saturatedPort returns a loopback port whose accept queue is full, so new
+// connections hang instead of being accepted or refused.
+func saturatedPort(t testing.TB) string {
+	t.Helper()
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Skip("raw sockets unavailable:", err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := strconv.Itoa(addr.(*syscall.SockaddrInet4).Port)
+
+	// never accepted, these fill the queue
+	for i := 0; i < 8; i++ {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", port), 100*time.Millisecond)
+		if err != nil {
+			return port
+		}
+		t.Cleanup(func() { conn.Close() })
+	}
+
+	t.Skip("accept queue never filled up")
+	return ""
+}
+
+func TestLocalProbeTimeoutIndependentOfRequestTimeout(t *testing.T) {
+	port := saturatedPort(t)
+
+	server := newFakeServer(t)
+	client, err := NewTunnelClient(testSDKConfig(server), "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := testConfig()
+	config.ProbeLocalOnStart = true
+	config.LocalProbeTimeout = 200 * time.Millisecond
+	config.RequestTimeout = time.Minute
+
+	start := time.Now()
+	err = client.Start(port, config)
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, ErrLocalBackendUnavailable) {
+		t.Fatalf("Start = %v, want ErrLocalBackendUnavailable", err)
+	}
+
+	if elapsed < config.LocalProbeTimeout || elapsed > 2*time.Second {
+		t.Errorf("probe gave up after %v, want about %v", elapsed, config.LocalProbeTimeout)
+	}
+}
+
+func TestClientStartTwiceOnSamePort(t *testing.T) {
+	server := newFakeServer(t)
+	client, err := NewTunnelClient(testSDKConfig(server), "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.StopAll()
+		client.Wait()
+	})
+
+	const starts = 8
+
+	var wg sync.WaitGroup
+	var started atomic.Int32
+	for i := 0; i < starts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := client.Start("8080", testConfig())
+			switch {
+			case err == nil:
+				started.Add(1)
+			case !errors.Is(err, ErrDuplicatePort):
+				t.Errorf("Start = %v, want ErrDuplicatePort", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := started.Load(); n != 1 {
+		t.Fatalf("%d concurrent Start calls succeeded, want 1", n)
+	}
+
+	server.accept()
+
+	select {
+	case <-server.conns:
+		t.Error("a second connection was established")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestLocalHostValidated(t *testing.T) {
+	for _, host := range []string{"http://10.0.0.2", "10.0.0.2:3000", "my host", "a..b"} {
+		config := testConfig()
+		config.LocalHost = host
+
+		if _, err := NewTunnelConn(config, &SDKConfig{}, "8080"); !errors.Is(err, ErrInvalidLocalHost) {
+			t.Errorf("LocalHost %q: err = %v, want ErrInvalidLocalHost", host, err)
+		}
+	}
+
+	for _, host := range []string{"", "172.17.0.2", "::1", "api.internal", "my_service"} {
+		config := testConfig()
+		config.LocalHost = host
+
+		if _, err := NewTunnelConn(config, &SDKConfig{}, "8080"); err != nil {
+			t.Errorf("LocalHost %q: %v", host, err)
+		}
+	}
+}
+
+func TestForwardToLocalHost(t *testing.T) {
+	var gotHost string
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHost = r.Host
+	}))
+
+	config := testConfig()
+	config.LocalHost = "127.0.0.1"
+
+	_, fc := newTestTunnel(t, config, port)
+
+	resp := fc.request(TunnelMessage{ID: "req-1", Method: http.MethodGet, Path: "/"})
+	if code := statusCode(t, resp); code != http.StatusOK {
+		t.Fatalf("status %d, want 200", code)
+	}
+
+	if want := "127.0.0.1:" + port; gotHost != want {
+		t.Errorf("backend saw Host %q, want %q", gotHost, want)
+	}
+}
+
+func TestNilConfigsDoNotShareState(t *testing.T) {
+	first, err := NewTunnelClient(nil, "token-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := NewTunnelClient(nil, "token-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.config == second.config || first.config.AuthToken != "token-1" {
+		t.Errorf("clients with nil config share %p, token %q", first.config, first.config.AuthToken)
+	}
+
+	if DefaultSDKConfig.AuthToken != "" || DefaultSDKConfig.OnConnected != nil {
+		t.Error("NewTunnelClient wrote to DefaultSDKConfig")
+	}
+
+	a, err := NewTunnelConn(nil, first.config, "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewTunnelConn(nil, second.config, "9090")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.config.LocalPort != "8080" || b.config.LocalPort != "9090" {
+		t.Errorf("local ports %s and %s, want 8080 and 9090", a.config.LocalPort, b.config.LocalPort)
+	}
+
+	if DefaultTunnelConfig.LocalPort != "" {
+		t.Errorf("NewTunnelConn set DefaultTunnelConfig.LocalPort to %s", DefaultTunnelConfig.LocalPort)
+	}
+}
+
+func TestClientRunsSeveralTunnels(t *testing.T) {
+	server := newFakeServer(t)
+	client, err := NewTunnelClient(testSDKConfig(server), "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.StopAll()
+		client.Wait()
+	})
+
+	var (
+		names = make(map[string]string)
+		ports = make(map[string]*fakeConn)
+	)
+	for _, name := range []string{"first", "second"} {
+		port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+
+		// Start returns while the tunnel keeps running
+		if err := client.Start(port, testConfig()); err != nil {
+			t.Fatal(err)
+		}
+
+		names[port] = name
+		ports[port] = server.accept()
+	}
+
+	for port, fc := range ports {
+		if client.Tunnel(port) == nil {
+			t.Fatalf("no tunnel on %s", port)
+		}
+
+		resp := fc.request(TunnelMessage{ID: port, Method: http.MethodGet, Path: "/"})
+		if resp.Body != names[port] {
+			t.Errorf("tunnel on %s answered %q, want %q", port, resp.Body, names[port])
+		}
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		client.StopAll()
+		client.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(testTimeout):
+		t.Fatal("StopAll did not end the tunnels")
+	}
+
+	for port := range ports {
+		if client.Tunnel(port) != nil {
+			t.Errorf("tunnel on %s still listed after StopAll", port)
+		}
+	}
+}
+
+func TestClientExposesTunnels(t *testing.T) {
+	server := newFakeServer(t)
+	client, err := NewTunnelClient(testSDKConfig(server), "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.StopAll()
+		client.Wait()
+	})
+
+	if err := client.Start("8080", testConfig()); err != nil {
+		t.Fatal(err)
+	}
+	server.accept()
+
+	conn := client.Tunnel("8080")
+	if conn == nil {
+		t.Fatal("Tunnel(8080) = nil, want the running tunnel")
+	}
+
+	if tunnels := client.Tunnels(); len(tunnels) != 1 || tunnels[0] != conn {
+		t.Errorf("Tunnels() = %v, want only the tunnel on 8080", tunnels)
+	}
+
+	if client.Tunnel("9090") != nil {
+		t.Error("Tunnel(9090) found a tunnel, want nil")
+	}
+
+	waitFor(t, func() bool { return conn.Status() == StatusConnected })
+
+	localURL, prodURL := conn.URLs()
+	if localURL != "http://tunnel-1.tunnel.test" || prodURL != "https://tunnel-1.tunnel.test" || conn.TunnelID() != "tunnel-1" {
+		t.Errorf("URLs() = %q, %q and TunnelID() = %q, want those of tunnel-1", localURL, prodURL, conn.TunnelID())
+	}
+
+	client.StopAll()
+	client.Wait()
+
+	if tunnels := client.Tunnels(); len(tunnels) != 0 {
+		t.Errorf("Tunnels() after StopAll = %v, want none", tunnels)
+	}
+}
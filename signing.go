@@ -0,0 +1,76 @@
+package sdk
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// maxSignatureAge is how far the timestamp of a signed message may be from
+// the local clock, bounding how long a captured message can be replayed.
+const maxSignatureAge = 5 * time.Minute
+
+// signMessage computes the HMAC-SHA256 signature of a tunnel message over
+// its ID, method, path, body encoding, headers and body. The headers,
+// HeaderSignatureTimestamp included, are canonicalized, quoted and sorted,
+// and only HeaderSignature itself is left out.
+func signMessage(secret string, msg TunnelMessage) string {
+	var headers []string
+	for key, value := range msg.Headers {
+		if key = http.CanonicalHeaderKey(key); key != HeaderSignature {
+			headers = append(headers, signedHeader(key, value))
+		}
+	}
+
+	for key, values := range msg.MultiHeaders {
+		if key = http.CanonicalHeaderKey(key); key != HeaderSignature {
+			for _, value := range values {
+				headers = append(headers, signedHeader(key, value))
+			}
+		}
+	}
+
+	slices.Sort(headers)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(msg.ID + "\n" + msg.Method + "\n" + msg.Path + "\n" + msg.BodyEncoding + "\n"))
+	for _, header := range headers {
+		mac.Write([]byte(header))
+	}
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(msg.Body))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedHeader is the signed form of one header line. Quoting keeps a value
+// containing a newline from passing for several headers.
+func signedHeader(key, value string) string {
+	return strconv.Quote(key) + ": " + strconv.Quote(value) + "\n"
+}
+
+// verifyMessage reports whether msg carries a valid signature for secret
+// and a timestamp within maxSignatureAge of now.
+func verifyMessage(secret string, msg TunnelMessage) bool {
+	signature, err := hex.DecodeString(headerValue(msg.Headers, HeaderSignature))
+	if err != nil || len(signature) == 0 {
+		return false
+	}
+
+	timestamp, err := strconv.ParseInt(headerValue(msg.Headers, HeaderSignatureTimestamp), 10, 64)
+	if err != nil {
+		return false
+	}
+
+	if age := time.Since(time.Unix(timestamp, 0)); age > maxSignatureAge || age < -maxSignatureAge {
+		return false
+	}
+
+	expected, _ := hex.DecodeString(signMessage(secret, msg))
+
+	return hmac.Equal(signature, expected)
+}
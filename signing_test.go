@@ -0,0 +1,116 @@
+package sdk
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const testSigningSecret = "signing-secret"
+
+// sign adds a timestamp taken at at and the signature to msg.
+func sign(msg TunnelMessage, at time.Time) TunnelMessage {
+	headers := make(map[string]string, len(msg.Headers)+2)
+	for key, value := range msg.Headers {
+		headers[key] = value
+	}
+
+	headers[HeaderSignatureTimestamp] = strconv.FormatInt(at.Unix(), 10)
+	msg.Headers = headers
+	msg.Headers[HeaderSignature] = signMessage(testSigningSecret, msg)
+
+	return msg
+}
+
+func TestVerifyMessage(t *testing.T) {
+	msg := sign(TunnelMessage{
+		Type:    TunnelRequest,
+		ID:      "1",
+		Method:  http.MethodPost,
+		Path:    "/transfer",
+		Headers: map[string]string{"Content-Type": "application/json"},
+		Body:    `{"amount":10}`,
+	}, time.Now())
+
+	if !verifyMessage(testSigningSecret, msg) {
+		t.Fatal("valid signature rejected")
+	}
+
+	tamper := map[string]func(msg *TunnelMessage){
+		"body":          func(msg *TunnelMessage) { msg.Body = `{"amount":1000}` },
+		"path":          func(msg *TunnelMessage) { msg.Path = "/admin" },
+		"header":        func(msg *TunnelMessage) { msg.Headers["Content-Type"] = "text/plain" },
+		"added header":  func(msg *TunnelMessage) { msg.Headers["Authorization"] = "Bearer x" },
+		"body encoding": func(msg *TunnelMessage) { msg.BodyEncoding = BodyEncodingBase64 },
+		"timestamp":     func(msg *TunnelMessage) { msg.Headers[HeaderSignatureTimestamp] = "1" },
+		"signature":     func(msg *TunnelMessage) { msg.Headers[HeaderSignature] = "00" + msg.Headers[HeaderSignature][2:] },
+	}
+
+	for name, change := range tamper {
+		tampered := msg
+		tampered.Headers = make(map[string]string, len(msg.Headers))
+		for key, value := range msg.Headers {
+			tampered.Headers[key] = value
+		}
+
+		change(&tampered)
+
+		if verifyMessage(testSigningSecret, tampered) {
+			t.Errorf("message with tampered %s accepted", name)
+		}
+	}
+
+	if verifyMessage("other-secret", msg) {
+		t.Error("message accepted with another secret")
+	}
+}
+
+func TestVerifyMessageRejectsStaleTimestamps(t *testing.T) {
+	for _, at := range []time.Time{
+		time.Now().Add(-maxSignatureAge - time.Minute),
+		time.Now().Add(maxSignatureAge + time.Minute),
+	} {
+		msg := sign(TunnelMessage{Type: TunnelRequest, ID: "1", Method: http.MethodGet, Path: "/"}, at)
+		if verifyMessage(testSigningSecret, msg) {
+			t.Errorf("message signed at %v accepted", at)
+		}
+	}
+
+	unstamped := TunnelMessage{Type: TunnelRequest, ID: "1", Method: http.MethodGet, Path: "/"}
+	unstamped.Headers = map[string]string{HeaderSignature: signMessage(testSigningSecret, unstamped)}
+	if verifyMessage(testSigningSecret, unstamped) {
+		t.Error("message without timestamp accepted")
+	}
+}
+
+func TestSignedRequestsThroughTunnel(t *testing.T) {
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+
+	server := newFakeServer(t)
+	sdkConfig := testSDKConfig(server)
+	sdkConfig.SigningSecret = testSigningSecret
+
+	conn, err := NewTunnelConn(testConfig(), sdkConfig, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fc := startTunnel(t, server, conn)
+
+	resp := fc.request(sign(TunnelMessage{ID: "1", Method: http.MethodGet, Path: "/"}, time.Now()))
+	if status := statusCode(t, resp); status != http.StatusOK {
+		t.Errorf("signed request answered %d, want 200", status)
+	}
+
+	tampered := sign(TunnelMessage{ID: "2", Method: http.MethodGet, Path: "/"}, time.Now())
+	tampered.Path = "/admin"
+
+	resp = fc.request(tampered)
+	if status := statusCode(t, resp); status != http.StatusUnauthorized {
+		t.Errorf("tampered request answered %d, want 401", status)
+	}
+}
@@ -0,0 +1,212 @@
+package sdk
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the traffic forwarded through a tunnel.
+type Stats struct {
+	Requests  uint64
+	Responses uint64
+	Errors    uint64
+
+	BytesIn  uint64
+	BytesOut uint64
+
+	TotalLatency   time.Duration
+	AverageLatency time.Duration
+
+	// UnexpectedDisconnects counts connections lost without Stop, and
+	// CleanDisconnects the ones closed by Stop. Reconnections counts
+	// successful connects after an unexpected disconnect, and Downtime the
+	// time spent disconnected in between, including an ongoing outage.
+	UnexpectedDisconnects uint64
+	CleanDisconnects      uint64
+	Reconnections         uint64
+	Downtime              time.Duration
+}
+
+// ShutdownReport summarizes a tunnel when it is stopped.
+type ShutdownReport struct {
+	TunnelID  string
+	LocalPort string
+
+	// Uptime is how long the last connection was up
+	Uptime time.Duration
+
+	Stats
+}
+
+func (r ShutdownReport) String() string {
+	return fmt.Sprintf("tunnel %s on port %s stopped after %s: %d requests, %d responses, %d errors, %d bytes in, %d bytes out, %d reconnections",
+		r.TunnelID, r.LocalPort, r.Uptime.Round(time.Second), r.Requests, r.Responses, r.Errors, r.BytesIn, r.BytesOut, r.Reconnections)
+}
+
+type tunnelStats struct {
+	// resetMu is held for reading while recording and for writing while
+	// resetting, so a reset never interleaves with a half-recorded request.
+	resetMu sync.RWMutex
+
+	requests  atomic.Uint64
+	responses atomic.Uint64
+	errors    atomic.Uint64
+
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+
+	latency atomic.Int64
+
+	unexpectedDisconnects atomic.Uint64
+	cleanDisconnects      atomic.Uint64
+	reconnections         atomic.Uint64
+
+	// downMu guards the outage bookkeeping
+	downMu   sync.Mutex
+	downtime time.Duration
+	downAt   time.Time
+
+	// recent holds the latencies of the last latencyWindow responses in a
+	// ring for percentiles
+	recentMu   sync.Mutex
+	recent     []time.Duration
+	recentNext int
+}
+
+// latencyWindow is how many recent responses latency percentiles cover.
+const latencyWindow = 1024
+
+func (s *tunnelStats) requestReceived(bytes int) {
+	s.resetMu.RLock()
+	defer s.resetMu.RUnlock()
+
+	s.requests.Add(1)
+	s.bytesIn.Add(uint64(bytes))
+}
+
+func (s *tunnelStats) responseSent(bytes int, latency time.Duration) {
+	s.resetMu.RLock()
+	defer s.resetMu.RUnlock()
+
+	s.responses.Add(1)
+	s.bytesOut.Add(uint64(bytes))
+	s.latency.Add(int64(latency))
+
+	s.recentMu.Lock()
+	if len(s.recent) < latencyWindow {
+		s.recent = append(s.recent, latency)
+	} else {
+		s.recent[s.recentNext] = latency
+		s.recentNext = (s.recentNext + 1) % latencyWindow
+	}
+	s.recentMu.Unlock()
+}
+
+// recentLatencies returns a copy of the latencies in the window.
+func (s *tunnelStats) recentLatencies() []time.Duration {
+	s.recentMu.Lock()
+	defer s.recentMu.Unlock()
+
+	return slices.Clone(s.recent)
+}
+
+func (s *tunnelStats) errorSent() {
+	s.resetMu.RLock()
+	defer s.resetMu.RUnlock()
+
+	s.errors.Add(1)
+}
+
+func (s *tunnelStats) disconnected(clean bool) {
+	s.resetMu.RLock()
+	defer s.resetMu.RUnlock()
+
+	if clean {
+		s.cleanDisconnects.Add(1)
+		return
+	}
+
+	s.unexpectedDisconnects.Add(1)
+
+	s.downMu.Lock()
+	s.downAt = time.Now()
+	s.downMu.Unlock()
+}
+
+func (s *tunnelStats) connected() {
+	s.resetMu.RLock()
+	defer s.resetMu.RUnlock()
+
+	s.downMu.Lock()
+	defer s.downMu.Unlock()
+
+	if s.downAt.IsZero() {
+		return
+	}
+
+	s.reconnections.Add(1)
+	s.downtime += time.Since(s.downAt)
+	s.downAt = time.Time{}
+}
+
+func (s *tunnelStats) snapshot() Stats {
+	s.resetMu.Lock()
+	defer s.resetMu.Unlock()
+
+	stats := Stats{
+		Requests:     s.requests.Load(),
+		Responses:    s.responses.Load(),
+		Errors:       s.errors.Load(),
+		BytesIn:      s.bytesIn.Load(),
+		BytesOut:     s.bytesOut.Load(),
+		TotalLatency: time.Duration(s.latency.Load()),
+
+		UnexpectedDisconnects: s.unexpectedDisconnects.Load(),
+		CleanDisconnects:      s.cleanDisconnects.Load(),
+		Reconnections:         s.reconnections.Load(),
+	}
+
+	s.downMu.Lock()
+	stats.Downtime = s.downtime
+	if !s.downAt.IsZero() {
+		stats.Downtime += time.Since(s.downAt)
+	}
+	s.downMu.Unlock()
+
+	if stats.Responses > 0 {
+		stats.AverageLatency = stats.TotalLatency / time.Duration(stats.Responses)
+	}
+
+	return stats
+}
+
+func (s *tunnelStats) reset() {
+	s.resetMu.Lock()
+	defer s.resetMu.Unlock()
+
+	s.requests.Store(0)
+	s.responses.Store(0)
+	s.errors.Store(0)
+	s.bytesIn.Store(0)
+	s.bytesOut.Store(0)
+	s.latency.Store(0)
+
+	s.unexpectedDisconnects.Store(0)
+	s.cleanDisconnects.Store(0)
+	s.reconnections.Store(0)
+
+	s.recentMu.Lock()
+	s.recent = nil
+	s.recentNext = 0
+	s.recentMu.Unlock()
+
+	s.downMu.Lock()
+	s.downtime = 0
+	if !s.downAt.IsZero() {
+		s.downAt = time.Now()
+	}
+	s.downMu.Unlock()
+}
@@ -0,0 +1,171 @@
+package sdk
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResetStatsKeepsOnlyLaterTraffic(t *testing.T) {
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+
+	conn, fc := newTestTunnel(t, nil, port)
+
+	forward := func(ids ...string) {
+		for _, id := range ids {
+			fc.request(TunnelMessage{ID: id, Method: http.MethodPost, Path: "/", Body: "ping"})
+		}
+	}
+
+	forward("1", "2", "3")
+	waitFor(t, func() bool { return conn.Stats().Responses == 3 })
+
+	conn.ResetStats()
+	if stats := conn.Stats(); stats != (Stats{}) {
+		t.Fatalf("stats after reset = %+v, want zero", stats)
+	}
+
+	forward("4", "5")
+	waitFor(t, func() bool { return conn.Stats().Responses == 2 })
+
+	stats := conn.Stats()
+	want := Stats{Requests: 2, Responses: 2, BytesIn: 8, BytesOut: 10}
+	if got := (Stats{Requests: stats.Requests, Responses: stats.Responses, BytesIn: stats.BytesIn, BytesOut: stats.BytesOut}); got != want {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+
+	if conn.Status() != StatusConnected {
+		t.Errorf("status after reset = %s, want %s", conn.Status(), StatusConnected)
+	}
+}
+
+func TestStatsCountDropsAndDowntime(t *testing.T) {
+	const outage = 100 * time.Millisecond
+
+	var handshakes atomic.Int32
+	server := newFakeServerWith(t, func(fc *fakeConn) error {
+		// every reconnect is slowed down so the outage is measurable
+		if handshakes.Add(1) > 1 {
+			time.Sleep(outage)
+		}
+
+		return acceptTunnel(fc)
+	})
+
+	config := testConfig()
+	config.AutoReconnect = true
+	config.ReconnectBackoff = time.Millisecond
+
+	conn, err := NewTunnelConn(config, testSDKConfig(server), "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fc := startTunnel(t, server, conn)
+
+	const drops = 2
+	for i := 0; i < drops; i++ {
+		fc.conn.Close()
+		fc = server.accept()
+		waitFor(t, func() bool { return conn.Stats().Reconnections == uint64(i+1) })
+	}
+
+	conn.Stop()
+
+	stats := conn.Stats()
+	if stats.UnexpectedDisconnects != drops || stats.Reconnections != drops || stats.CleanDisconnects != 1 {
+		t.Errorf("got %d unexpected disconnects, %d reconnections and %d clean disconnects, want %d, %d and 1",
+			stats.UnexpectedDisconnects, stats.Reconnections, stats.CleanDisconnects, drops, drops)
+	}
+
+	if stats.Downtime < drops*outage || stats.Downtime > drops*outage+time.Second {
+		t.Errorf("Downtime = %v, want about %v", stats.Downtime, drops*outage)
+	}
+
+	// the downtime stops growing once reconnected and stopped
+	time.Sleep(20 * time.Millisecond)
+	if downtime := conn.Stats().Downtime; downtime != stats.Downtime {
+		t.Errorf("Downtime grew from %v to %v after Stop", stats.Downtime, downtime)
+	}
+}
+
+func TestShutdownReport(t *testing.T) {
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+
+	server := newFakeServer(t)
+	reports := make(chan ShutdownReport, 1)
+	sdkConfig := testSDKConfig(server)
+	sdkConfig.OnShutdown = func(report ShutdownReport) { reports <- report }
+
+	conn, err := NewTunnelConn(testConfig(), sdkConfig, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fc := startTunnel(t, server, conn)
+
+	fc.request(TunnelMessage{ID: "1", Method: http.MethodPost, Path: "/", Body: "ping"})
+	fc.request(TunnelMessage{ID: "2", Method: http.MethodPost, Path: "/", Body: "ping"})
+	fc.request(TunnelMessage{ID: "3", Method: http.MethodGet, Path: "relative"})
+
+	time.Sleep(20 * time.Millisecond)
+	conn.Stop()
+	conn.Stop()
+
+	report := <-reports
+	if report.TunnelID != "tunnel-1" || report.LocalPort != port {
+		t.Errorf("report for tunnel %q on port %q, want tunnel-1 on %s", report.TunnelID, report.LocalPort, port)
+	}
+
+	if report.Requests != 3 || report.Responses != 2 || report.Errors != 1 {
+		t.Errorf("report counts %d requests, %d responses, %d errors, want 3, 2 and 1", report.Requests, report.Responses, report.Errors)
+	}
+
+	if report.BytesIn != 8 || report.BytesOut != 10 {
+		t.Errorf("report counts %d bytes in and %d out, want 8 and 10", report.BytesIn, report.BytesOut)
+	}
+
+	if report.Uptime < 20*time.Millisecond || report.CleanDisconnects != 1 {
+		t.Errorf("report uptime %v with %d clean disconnects", report.Uptime, report.CleanDisconnects)
+	}
+
+	select {
+	case <-reports:
+		t.Error("second Stop sent another report")
+	default:
+	}
+}
+
+func TestShutdownReportAfterDrop(t *testing.T) {
+	server := newFakeServer(t)
+	reports := make(chan ShutdownReport, 1)
+	sdkConfig := testSDKConfig(server)
+	sdkConfig.OnShutdown = func(report ShutdownReport) { reports <- report }
+
+	conn, err := NewTunnelConn(testConfig(), sdkConfig, "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fc := startTunnel(t, server, conn)
+
+	fc.conn.Close()
+	waitFor(t, func() bool { return conn.Status() == StatusDisconnected })
+
+	conn.Stop()
+
+	report := <-reports
+	if report.TunnelID != "tunnel-1" || report.UnexpectedDisconnects != 1 || report.CleanDisconnects != 0 {
+		t.Errorf("report after a drop = %+v, want one unexpected disconnect for tunnel-1", report)
+	}
+
+	if report.Uptime != 0 {
+		t.Errorf("report uptime %v while already disconnected, want 0", report.Uptime)
+	}
+}
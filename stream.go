@@ -0,0 +1,137 @@
+package sdk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// streamChunkSize is the body size carried by each TunnelResponseChunk.
+const streamChunkSize = 32 * 1024
+
+// shouldStream reports whether the body of resp is sent in chunks.
+func (c *TunnelConn) shouldStream(resp *http.Response) bool {
+	if !c.config.StreamResponses {
+		return false
+	}
+
+	threshold := c.config.StreamThreshold
+	if threshold <= 0 {
+		threshold = DefaultStreamThreshold
+	}
+
+	return resp.ContentLength < 0 || resp.ContentLength > threshold
+}
+
+// streamResponse sends the status and headers of resp, then its body in
+// chunks of at most streamChunkSize, so memory stays bounded whatever the
+// body size. The last chunk has an empty body and, when the body couldn't be
+// read entirely or was cut after MaxStreamDuration, carries
+// HeaderTunnelIncomplete.
+func (c *TunnelConn) streamResponse(ctx context.Context, msg TunnelMessage, resp *http.Response, start time.Time) {
+	var expired atomic.Bool
+	if c.config.MaxStreamDuration > 0 {
+		timer := time.AfterFunc(c.config.MaxStreamDuration, func() {
+			expired.Store(true)
+			resp.Body.Close()
+		})
+		defer timer.Stop()
+	}
+
+	c.sdkConfig.currentCallbacks().OnSedingResponse(msg, resp, nil)
+
+	headers, multiHeaders := c.responseHeaders(resp)
+	headers[HeaderTunnelStreamed] = "true"
+	delete(headers, "Content-Length")
+
+	err := c.send(TunnelMessage{
+		Type:         TunnelResponse,
+		ID:           msg.ID,
+		Headers:      headers,
+		MultiHeaders: multiHeaders,
+	})
+	if err != nil {
+		c.inflight.Delete(msg.ID)
+		c.reportSendError("response", err)
+		return
+	}
+
+	var (
+		sent    int
+		readErr error
+		buf     = make([]byte, streamChunkSize)
+	)
+
+	for {
+		n, err := readChunk(resp.Body, buf)
+		if n > 0 {
+			if !c.consumeQuota(n) {
+				readErr = errors.New("session byte quota exceeded")
+				break
+			}
+
+			if err := c.send(TunnelMessage{Type: TunnelResponseChunk, ID: msg.ID, Body: string(buf[:n])}); err != nil {
+				c.inflight.Delete(msg.ID)
+				c.reportSendError("response chunk", err)
+				return
+			}
+
+			sent += n
+		}
+
+		if err != nil && expired.Load() {
+			readErr = fmt.Errorf("stream cut after MaxStreamDuration %s", c.config.MaxStreamDuration)
+			break
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			readErr = err
+			break
+		}
+	}
+
+	if readErr != nil && requestCancelled(ctx) {
+		// the public client went away, nobody is waiting for the rest
+		c.inflight.Delete(msg.ID)
+		return
+	}
+
+	last := TunnelMessage{Type: TunnelResponseChunk, ID: msg.ID}
+	if readErr != nil {
+		c.onError(errors.New("Response body incomplete: " + readErr.Error()))
+		last.Headers = map[string]string{HeaderTunnelIncomplete: "true"}
+	}
+
+	if err := c.send(last); err != nil {
+		c.reportSendError("response chunk", err)
+	}
+
+	c.finishRequest(msg.ID, strconv.Itoa(resp.StatusCode), sent)
+	c.stats.responseSent(sent, time.Since(start))
+}
+
+// readChunk fills buf from body, stopping early at the end of the body or on
+// an error. Unlike io.ReadFull it leaves io.ErrUnexpectedEOF to mean what the
+// body reported, a local service gone mid-body, not a short last chunk.
+func readChunk(body io.Reader, buf []byte) (int, error) {
+	var n int
+	for n < len(buf) {
+		m, err := body.Read(buf[n:])
+		n += m
+
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
@@ -0,0 +1,194 @@
+package sdk
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamedResponseOverQuotaIsCut(t *testing.T) {
+	chunk := strings.Repeat("s", 16*1024)
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 8; i++ {
+			w.Write([]byte(chunk))
+			w.(http.Flusher).Flush()
+		}
+	}))
+
+	config := testConfig()
+	config.StreamResponses = true
+	config.SessionByteQuota = 64 * 1024
+
+	_, fc := newTestTunnel(t, config, port)
+
+	resp := fc.request(TunnelMessage{ID: "1", Method: http.MethodGet, Path: "/"})
+	if resp.Headers[HeaderTunnelIncomplete] != "true" {
+		t.Errorf("stream over quota not marked %s", HeaderTunnelIncomplete)
+	}
+
+	if len(resp.Body) > int(config.SessionByteQuota) {
+		t.Errorf("forwarded %d bytes, over the %d byte quota", len(resp.Body), config.SessionByteQuota)
+	}
+}
+
+func TestLargeResponseStreamedInChunks(t *testing.T) {
+	body := strings.Repeat("d", 3*streamChunkSize+100)
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+
+	config := testConfig()
+	config.StreamResponses = true
+	config.StreamThreshold = 1024
+
+	_, fc := newTestTunnel(t, config, port)
+
+	if err := fc.send(TunnelMessage{Type: TunnelRequest, ID: "1", Method: http.MethodGet, Path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	head := fc.recv()
+	if head.Type != TunnelResponse || head.Headers[HeaderTunnelStreamed] == "" {
+		t.Fatalf("got message %d with headers %v, want a streamed response head", head.Type, head.Headers)
+	}
+
+	var (
+		received strings.Builder
+		chunks   int
+	)
+
+	for {
+		chunk := fc.recv()
+		if chunk.Type != TunnelResponseChunk {
+			t.Fatalf("got message %d, want a response chunk", chunk.Type)
+		}
+
+		if err := decodeBody(&chunk); err != nil {
+			t.Fatal(err)
+		}
+
+		if chunk.Body == "" {
+			break
+		}
+
+		if len(chunk.Body) > streamChunkSize {
+			t.Errorf("chunk of %d bytes, over %d", len(chunk.Body), streamChunkSize)
+		}
+
+		chunks++
+		received.WriteString(chunk.Body)
+	}
+
+	if received.String() != body || chunks < 4 {
+		t.Errorf("got %d bytes in %d chunks, want %d bytes in at least 4", received.Len(), chunks, len(body))
+	}
+}
+
+func TestStreamOutlivesResponseTimeout(t *testing.T) {
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			io.WriteString(w, "tick\n")
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+
+	config := testConfig()
+	config.StreamResponses = true
+	config.ResponseTimeout = 100 * time.Millisecond
+	config.RequestTimeout = 100 * time.Millisecond
+
+	_, fc := newTestTunnel(t, config, port)
+
+	resp := fc.request(TunnelMessage{ID: "1", Method: http.MethodGet, Path: "/events"})
+	if resp.Body != strings.Repeat("tick\n", 5) {
+		t.Errorf("stream lasting past the timeout got %q", resp.Body)
+	}
+
+	if resp.Headers[HeaderTunnelTruncated] != "" || resp.Headers[HeaderTunnelIncomplete] != "" {
+		t.Errorf("stream marked cut: %v", resp.Headers)
+	}
+}
+
+func TestEndlessStreamCutAtMaxStreamDuration(t *testing.T) {
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+
+		// a misbehaving SSE backend that never ends the stream
+		for {
+			if _, err := io.WriteString(w, "data: tick\n\n"); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}))
+
+	config := testConfig()
+	config.StreamResponses = true
+	config.MaxStreamDuration = 200 * time.Millisecond
+
+	_, fc := newTestTunnel(t, config, port)
+
+	start := time.Now()
+	resp := fc.request(TunnelMessage{ID: "1", Method: http.MethodGet, Path: "/events"})
+	elapsed := time.Since(start)
+
+	if resp.Headers[HeaderTunnelIncomplete] != "true" {
+		t.Errorf("endless stream not marked %s", HeaderTunnelIncomplete)
+	}
+
+	if !strings.HasPrefix(resp.Body, "data: tick\n\n") {
+		t.Errorf("stream cut before forwarding any event, got %q", resp.Body)
+	}
+
+	if elapsed < config.MaxStreamDuration || elapsed > 10*config.MaxStreamDuration {
+		t.Errorf("stream ended after %v, want about %v", elapsed, config.MaxStreamDuration)
+	}
+}
+
+func TestStreamCutMidBodyMarkedIncomplete(t *testing.T) {
+	const sent = 100_000
+
+	tests := []struct {
+		name       string
+		declared   int
+		incomplete bool
+	}{
+		// the last chunk is short either way, only the cut one is incomplete
+		{"complete", sent, false},
+		{"cut", 5_000_000, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := rawBackendPort(t, func(w io.Writer) {
+				fmt.Fprintf(w, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n", tt.declared)
+				io.WriteString(w, strings.Repeat("c", sent))
+			})
+
+			config := testConfig()
+			config.StreamResponses = true
+			config.StreamThreshold = 1024
+
+			_, fc := newTestTunnel(t, config, port)
+
+			resp := fc.request(TunnelMessage{ID: "1", Method: http.MethodGet, Path: "/"})
+			if len(resp.Body) != sent {
+				t.Errorf("forwarded %d bytes, want the %d sent", len(resp.Body), sent)
+			}
+
+			if incomplete := resp.Headers[HeaderTunnelIncomplete] == "true"; incomplete != tt.incomplete {
+				t.Errorf("marked incomplete %v, want %v", incomplete, tt.incomplete)
+			}
+		})
+	}
+}
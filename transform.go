@@ -0,0 +1,64 @@
+package sdk
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// transformResponse runs the ResponseTransformers entry matching the media
+// type of resp, applying the header changes it makes to resp.Header. A
+// compressed body that wasn't decompressed is left alone.
+func (c *TunnelConn) transformResponse(resp *http.Response, body []byte) []byte {
+	if len(c.config.ResponseTransformers) == 0 || resp.Header.Get("Content-Encoding") != "" {
+		return body
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return body
+	}
+
+	transform := c.config.ResponseTransformers[mediaType]
+	if transform == nil {
+		for key, fn := range c.config.ResponseTransformers {
+			if strings.EqualFold(key, mediaType) {
+				transform = fn
+				break
+			}
+		}
+	}
+
+	if transform == nil {
+		return body
+	}
+
+	headers := make(map[string]string, len(resp.Header))
+	for key := range resp.Header {
+		headers[key] = resp.Header.Get(key)
+	}
+
+	size := len(body)
+	body = transform(body, headers)
+
+	for key, values := range resp.Header {
+		value, ok := headers[key]
+		if !ok {
+			resp.Header.Del(key)
+		} else if len(values) == 0 || values[0] != value {
+			resp.Header.Set(key, value)
+		}
+
+		delete(headers, key)
+	}
+
+	for key, value := range headers {
+		resp.Header.Set(key, value)
+	}
+
+	if len(body) != size {
+		resp.Header.Del("Content-Length")
+	}
+
+	return body
+}
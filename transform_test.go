@@ -0,0 +1,51 @@
+package sdk
+
+import (
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestResponseTransformerMatchesContentType(t *testing.T) {
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api" {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "text/html")
+		}
+
+		io.WriteString(w, "body")
+	}))
+
+	var calls int
+	config := testConfig()
+	config.ResponseTransformers = map[string]func(body []byte, headers map[string]string) []byte{
+		"application/json": func(body []byte, headers map[string]string) []byte {
+			calls++
+			headers["Access-Control-Allow-Origin"] = "*"
+			return append(body, " transformed"...)
+		},
+	}
+
+	_, fc := newTestTunnel(t, config, port)
+
+	resp := fc.request(TunnelMessage{ID: "json", Method: http.MethodGet, Path: "/api"})
+	if resp.Body != "body transformed" {
+		t.Errorf("JSON body = %q, want it transformed", resp.Body)
+	}
+	if cors := resp.Headers["Access-Control-Allow-Origin"]; cors != "*" {
+		t.Errorf("JSON Access-Control-Allow-Origin = %q, want *", cors)
+	}
+
+	resp = fc.request(TunnelMessage{ID: "html", Method: http.MethodGet, Path: "/"})
+	if resp.Body != "body" {
+		t.Errorf("HTML body = %q, want it untouched", resp.Body)
+	}
+	if _, ok := resp.Headers["Access-Control-Allow-Origin"]; ok {
+		t.Error("HTML response got the JSON transformer's header")
+	}
+
+	if calls != 1 {
+		t.Errorf("transformer ran %d times, want once", calls)
+	}
+}
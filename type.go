@@ -12,6 +12,16 @@ const (
 	TunnelAuthRequest
 	TunnelAuthResponse
 	TunnelAuthFailure
+
+	TunnelEarlyHints
+	TunnelRequestCancelled
+
+	TunnelResponseChunk
+
+	TunnelPing
+	TunnelPong
+
+	TunnelStreamData
 )
 
 type TunnelMessage struct {
@@ -20,9 +30,17 @@ type TunnelMessage struct {
 	Method  string            `json:"method,omitempty"`
 	Path    string            `json:"path,omitempty"`
 	Headers map[string]string `json:"headers,omitempty"`
-	Body    string            `json:"body,omitempty"`
+	// MultiHeaders carries every value of headers repeated in the message,
+	// such as Set-Cookie. Headers still holds their first value.
+	MultiHeaders map[string][]string `json:"multi_headers,omitempty"`
+	Body         string              `json:"body,omitempty"`
+	// BodyEncoding is BodyEncodingBase64 when Body is base64 encoded so
+	// binary payloads survive JSON, empty when Body is plain text.
+	BodyEncoding string `json:"body_encoding,omitempty"`
 }
 
+const BodyEncodingBase64 = "base64"
+
 type TunnelStatus string
 
 const (
@@ -38,4 +56,65 @@ const (
 const (
 	HeaderLocalUrl = "Local-URL"
 	HeaderProdUrl  = "Prod-URL"
+
+	HeaderProtocolVersion = "Protocol-Version"
+	HeaderResumeToken     = "Resume-Token"
+
+	HeaderSignature = "X-Tunnel-Signature"
+	// HeaderSignatureTimestamp is the signing time of a signed message, in
+	// Unix seconds
+	HeaderSignatureTimestamp = "X-Tunnel-Timestamp"
+	HeaderForwardedPort      = "X-Forwarded-Port"
+	HeaderMethodOverride     = "X-HTTP-Method-Override"
+	// HeaderTunnelTruncated marks a response whose body was cut short
+	HeaderTunnelTruncated = "X-Tunnel-Truncated"
+	// HeaderTunnelIncomplete marks a partial body forwarded after the local
+	// service failed mid-response
+	HeaderTunnelIncomplete = "X-Tunnel-Incomplete"
+	// HeaderTunnelStreamed marks a response whose body follows in
+	// TunnelResponseChunk messages, or a request whose body follows in
+	// TunnelStreamData messages, ended by one with an empty body
+	HeaderTunnelStreamed = "X-Tunnel-Streamed"
+)
+
+// PartialResponsePolicy decides what happens when the local service fails
+// while sending a response body.
+type PartialResponsePolicy int
+
+const (
+	// PartialResponseError answers with 500, discarding the partial body
+	PartialResponseError PartialResponsePolicy = iota
+	// PartialResponseForward forwards the partial body marked with
+	// X-Tunnel-Incomplete
+	PartialResponseForward
+)
+
+// EarlyRequestPolicy decides what happens to requests the server sends
+// before the tunnel is established.
+type EarlyRequestPolicy int
+
+const (
+	// EarlyRequestBuffer holds them and forwards them once connected
+	EarlyRequestBuffer EarlyRequestPolicy = iota
+	// EarlyRequestReject answers them with 503
+	EarlyRequestReject
+)
+
+// OverflowPolicy decides what happens to a request arriving while
+// MaxConcurrentRequests are already being forwarded.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock holds the request until another one completes
+	OverflowBlock OverflowPolicy = iota
+	// OverflowReject answers with 503 right away
+	OverflowReject
+)
+
+// Protocol versions understood by this SDK. ProtocolVersion is sent in the
+// auth request unless SDKConfig.ProtocolVersion overrides it.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+	MaxProtocolVersion = 1
 )
@@ -0,0 +1,215 @@
+package sdk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// uploadQueueSize bounds the TunnelStreamData frames waiting to be written
+// to the local service. Once full, the read loop waits for the local
+// service to catch up, which stops reading from the tunnel and pushes back
+// on the server.
+const uploadQueueSize = 16
+
+// upload is the body of a request streamed in TunnelStreamData frames. The
+// frames are queued by the read loop and written to a pipe read by the
+// forwarded request.
+type upload struct {
+	r      *io.PipeReader
+	w      *io.PipeWriter
+	chunks chan TunnelMessage
+	done   chan struct{}
+
+	// buffers, when set, holds the bytes of the queued frames
+	buffers *bufferBudget
+
+	// failStatus and failErr tell the request handler why the upload was
+	// aborted, see fail
+	failMu     sync.Mutex
+	failStatus int
+	failErr    error
+}
+
+func newUpload(buffers *bufferBudget) *upload {
+	r, w := io.Pipe()
+	u := &upload{
+		r:       r,
+		w:       w,
+		chunks:  make(chan TunnelMessage, uploadQueueSize),
+		done:    make(chan struct{}),
+		buffers: buffers,
+	}
+
+	go u.run()
+
+	return u
+}
+
+func (u *upload) run() {
+	for {
+		select {
+		case <-u.done:
+			return
+		case chunk := <-u.chunks:
+			if chunk.Body == "" {
+				if headerValue(chunk.Headers, HeaderTunnelIncomplete) != "" {
+					u.w.CloseWithError(errors.New("request body upload aborted"))
+				} else {
+					u.w.Close()
+				}
+
+				return
+			}
+
+			_, err := io.Copy(u.w, strings.NewReader(chunk.Body))
+			u.release(len(chunk.Body))
+
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// addUploadFrame queues a decoded frame of u, waiting while the queue is
+// full until the upload or the connection ends. It aborts the upload when
+// the buffer budget is exhausted.
+func (c *TunnelConn) addUploadFrame(u *upload, chunk TunnelMessage, linkDone <-chan struct{}) {
+	if u.buffers != nil && !u.buffers.reserve(int64(len(chunk.Body))) {
+		u.fail(http.StatusServiceUnavailable, errBufferLimit)
+		return
+	}
+
+	select {
+	case u.chunks <- chunk:
+		return
+	case <-u.done:
+		u.release(len(chunk.Body))
+		return
+	default:
+	}
+
+	resume := c.stallReads()
+	defer resume()
+
+	select {
+	case u.chunks <- chunk:
+	case <-u.done:
+		u.release(len(chunk.Body))
+	case <-linkDone:
+		u.release(len(chunk.Body))
+	}
+}
+
+func (u *upload) release(n int) {
+	if u.buffers != nil {
+		u.buffers.used.Add(-int64(n))
+	}
+}
+
+// fail aborts the upload, so the request fails with err instead of
+// forwarding a partial body. Only the first failure is kept.
+func (u *upload) fail(status int, err error) {
+	u.failMu.Lock()
+	if u.failErr == nil {
+		u.failStatus, u.failErr = status, err
+	}
+	u.failMu.Unlock()
+
+	u.w.CloseWithError(err)
+}
+
+// failure returns the status and error the upload was aborted with, err is
+// nil when it wasn't.
+func (u *upload) failure() (status int, err error) {
+	if u == nil {
+		return 0, nil
+	}
+
+	u.failMu.Lock()
+	defer u.failMu.Unlock()
+
+	return u.failStatus, u.failErr
+}
+
+// close ends the upload once the request is over, unblocking its writer.
+func (u *upload) close() {
+	if u == nil {
+		return
+	}
+
+	close(u.done)
+	u.r.CloseWithError(io.ErrClosedPipe)
+
+	// give back the budget held by frames that were never written
+	for {
+		select {
+		case chunk := <-u.chunks:
+			u.release(len(chunk.Body))
+		default:
+			return
+		}
+	}
+}
+
+// startUpload registers the body of a streamed request so its frames can
+// be routed to it.
+func (c *TunnelConn) startUpload(msg TunnelMessage) *upload {
+	if msg.Headers[HeaderTunnelStreamed] == "" {
+		return nil
+	}
+
+	u := newUpload(c.buffers)
+	if _, loaded := c.uploads.LoadOrStore(msg.ID, u); loaded {
+		// a duplicate request, its handler will refuse it
+		u.close()
+		return nil
+	}
+
+	return u
+}
+
+func (c *TunnelConn) finishUpload(requestID string, u *upload) {
+	if u == nil {
+		return
+	}
+
+	c.uploads.CompareAndDelete(requestID, u)
+	u.close()
+}
+
+// uploadData routes a TunnelStreamData frame to the body it belongs to,
+// checking it like a request: its signature, then the session quota.
+func (c *TunnelConn) uploadData(msg TunnelMessage, linkDone <-chan struct{}) {
+	value, ok := c.uploads.Load(msg.ID)
+	if !ok {
+		return
+	}
+
+	u := value.(*upload)
+
+	msg.Headers = canonicalHeaders(msg.Headers)
+	if c.sdkConfig.SigningSecret != "" && !verifyMessage(c.sdkConfig.SigningSecret, msg) {
+		err := fmt.Errorf("%w: upload frame of request %s", ErrInvalidSignature, msg.ID)
+		c.onError(err)
+		u.fail(http.StatusUnauthorized, err)
+
+		return
+	}
+
+	if err := decodeBody(&msg); err != nil {
+		u.fail(http.StatusBadRequest, err)
+		return
+	}
+
+	if !c.consumeQuota(len(msg.Body)) {
+		u.fail(http.StatusRequestEntityTooLarge, errors.New("session byte quota exceeded"))
+		return
+	}
+
+	c.addUploadFrame(u, msg, linkDone)
+}
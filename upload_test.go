@@ -0,0 +1,175 @@
+package sdk
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sendUpload sends a streamed request and its body in frames, without the
+// final empty frame when incomplete is set.
+func sendUpload(t testing.TB, fc *fakeConn, id string, frames []string, incomplete bool) {
+	t.Helper()
+
+	err := fc.send(TunnelMessage{
+		Type:    TunnelRequest,
+		ID:      id,
+		Method:  http.MethodPost,
+		Path:    "/upload",
+		Headers: map[string]string{HeaderTunnelStreamed: "true"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, frame := range frames {
+		if err := fc.send(TunnelMessage{Type: TunnelStreamData, ID: id, Body: frame}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !incomplete {
+		if err := fc.send(TunnelMessage{Type: TunnelStreamData, ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUploadOverQuotaIsAborted(t *testing.T) {
+	received := make(chan int, 1)
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		received <- int(n)
+	}))
+
+	config := testConfig()
+	config.SessionByteQuota = 64 * 1024
+
+	_, fc := newTestTunnel(t, config, port)
+
+	frame := strings.Repeat("u", 16*1024)
+	sendUpload(t, fc, "1", []string{frame, frame, frame, frame, frame, frame}, false)
+
+	resp := fc.response("1")
+	if status := statusCode(t, resp); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want 413", status)
+	}
+
+	// the request may fail before the backend sees it at all
+	select {
+	case n := <-received:
+		if n > int(config.SessionByteQuota) {
+			t.Errorf("backend received %d bytes, over the %d byte quota", n, config.SessionByteQuota)
+		}
+	default:
+	}
+}
+
+func TestUploadStreamedIncrementally(t *testing.T) {
+	chunks := make(chan string)
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 1024)
+		for {
+			n, err := r.Body.Read(buf)
+			if n > 0 {
+				chunks <- string(buf[:n])
+			}
+
+			if err != nil {
+				close(chunks)
+				return
+			}
+		}
+	}))
+
+	_, fc := newTestTunnel(t, nil, port)
+
+	sendUpload(t, fc, "1", []string{"first"}, true)
+
+	// the rest of the upload is sent only once the backend has the start
+	select {
+	case chunk := <-chunks:
+		if chunk != "first" {
+			t.Fatalf("backend read %q first, want first", chunk)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("backend got nothing before the upload completed")
+	}
+
+	for _, frame := range []string{"second", ""} {
+		if err := fc.send(TunnelMessage{Type: TunnelStreamData, ID: "1", Body: frame}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var rest strings.Builder
+	for chunk := range chunks {
+		rest.WriteString(chunk)
+	}
+
+	if rest.String() != "second" {
+		t.Errorf("backend read %q after the first frame, want second", rest.String())
+	}
+
+	if status := statusCode(t, fc.response("1")); status != http.StatusOK {
+		t.Errorf("status = %d, want 200", status)
+	}
+}
+
+func TestLargeUploadAppliesBackpressure(t *testing.T) {
+	const (
+		frames    = 128
+		frameSize = 32 * 1024
+	)
+
+	port := backendPort(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a slow reader, the frames arrive much faster than it consumes them
+		var (
+			total int
+			buf   = make([]byte, frameSize)
+		)
+		for {
+			n, err := io.ReadFull(r.Body, buf)
+			total += n
+			if err != nil {
+				break
+			}
+
+			time.Sleep(4 * time.Millisecond)
+		}
+
+		fmt.Fprint(w, total)
+	}))
+
+	config := testConfig()
+	// the upload lasts several times the keepalive timeout
+	config.KeepaliveInterval = 20 * time.Millisecond
+	config.KeepaliveTimeout = 100 * time.Millisecond
+
+	conn, fc := newTestTunnel(t, config, port)
+
+	frame := strings.Repeat("u", frameSize)
+	body := make([]string, frames)
+	for i := range body {
+		body[i] = frame
+	}
+
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		sendUpload(t, fc, "1", body, false)
+	}()
+
+	resp := fc.response("1")
+	if status := statusCode(t, resp); status != http.StatusOK || resp.Body != fmt.Sprint(frames*frameSize) {
+		t.Fatalf("upload answered %d %q, want 200 with all %d bytes", status, resp.Body, frames*frameSize)
+	}
+	<-sent
+
+	if stats := conn.Stats(); stats.UnexpectedDisconnects != 0 {
+		t.Errorf("%d unexpected disconnects while the upload was held back", stats.UnexpectedDisconnects)
+	}
+}
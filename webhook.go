@@ -0,0 +1,127 @@
+package sdk
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	EventConnected    = "connected"
+	EventDisconnected = "disconnected"
+	EventReconnecting = "reconnecting"
+	EventError        = "error"
+
+	webhookAttempts  = 3
+	webhookMaxQueued = 64
+)
+
+// WebhookEvent is the JSON payload POSTed to SDKConfig.WebhookURL.
+type WebhookEvent struct {
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	TunnelID  string    `json:"tunnel_id,omitempty"`
+	LocalPort string    `json:"local_port,omitempty"`
+	ProdURL   string    `json:"prod_url,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// webhookNotifier delivers events in the background one at a time, in the
+// order they happened, so the receiver sees the lifecycle of the tunnel as
+// it went. Pending lifecycle events go before pending errors, and the
+// oldest are dropped when too many are queued. Deliveries are retried a few
+// times, a slow or failing webhook never holds up the tunnel.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	lifecycle []WebhookEvent
+	errors    []WebhookEvent
+	running   bool
+}
+
+func newWebhookNotifier(url string) *webhookNotifier {
+	return &webhookNotifier{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (w *webhookNotifier) notify(event WebhookEvent) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if event.Event == EventError {
+		w.errors = appendBounded(w.errors, event)
+	} else {
+		w.lifecycle = appendBounded(w.lifecycle, event)
+	}
+
+	// the delivery goroutine runs only while events are queued
+	if !w.running {
+		w.running = true
+		go w.run()
+	}
+}
+
+// appendBounded appends event to queue, dropping the oldest one when it
+// already holds webhookMaxQueued.
+func appendBounded(queue []WebhookEvent, event WebhookEvent) []WebhookEvent {
+	if len(queue) >= webhookMaxQueued {
+		queue = queue[1:]
+	}
+
+	return append(queue, event)
+}
+
+func (w *webhookNotifier) run() {
+	for {
+		w.mu.Lock()
+
+		var event WebhookEvent
+		switch {
+		case len(w.lifecycle) > 0:
+			event, w.lifecycle = w.lifecycle[0], w.lifecycle[1:]
+		case len(w.errors) > 0:
+			event, w.errors = w.errors[0], w.errors[1:]
+		default:
+			w.running = false
+			w.mu.Unlock()
+			return
+		}
+
+		w.mu.Unlock()
+
+		w.deliver(event)
+	}
+}
+
+func (w *webhookNotifier) deliver(event WebhookEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	for attempt := 0; attempt < webhookAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+
+		resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			continue
+		}
+
+		resp.Body.Close()
+		if resp.StatusCode < 500 {
+			return
+		}
+	}
+}
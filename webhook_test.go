@@ -0,0 +1,138 @@
+package sdk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookEvents(t *testing.T) {
+	events := make(chan WebhookEvent, 8)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event WebhookEvent
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("webhook got %s with Content-Type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("webhook payload: %v", err)
+		}
+
+		events <- event
+	}))
+	t.Cleanup(hook.Close)
+
+	server := newFakeServer(t)
+	sdkConfig := testSDKConfig(server)
+	sdkConfig.WebhookURL = hook.URL
+
+	conn, err := NewTunnelConn(testConfig(), sdkConfig, "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startTunnel(t, server, conn)
+	tunnelID := conn.TunnelID()
+
+	conn.onError(errors.New("backend went away"))
+	conn.Stop()
+
+	received := make(map[string]WebhookEvent)
+	for len(received) < 3 {
+		select {
+		case event := <-events:
+			received[event.Event] = event
+		case <-time.After(testTimeout):
+			t.Fatalf("got events %v, want connected, error and disconnected", received)
+		}
+	}
+
+	for _, name := range []string{EventConnected, EventError, EventDisconnected} {
+		event, ok := received[name]
+		if !ok {
+			t.Errorf("no %s event in %v", name, received)
+			continue
+		}
+
+		if event.TunnelID != tunnelID || event.LocalPort != "8080" || event.Time.IsZero() {
+			t.Errorf("%s event = %+v, want tunnel %s on port 8080", name, event, tunnelID)
+		}
+	}
+
+	if received[EventConnected].ProdURL == "" {
+		t.Errorf("connected event without prod URL: %+v", received[EventConnected])
+	}
+
+	if received[EventError].Error != "backend went away" {
+		t.Errorf("error event = %+v, want the error message", received[EventError])
+	}
+}
+
+func TestWebhookDeliversLifecycleInOrder(t *testing.T) {
+	const errs = 20
+
+	var (
+		mu          sync.Mutex
+		received    []string
+		delivering  atomic.Int32
+		overlapping atomic.Bool
+	)
+
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if delivering.Add(1) > 1 {
+			overlapping.Store(true)
+		}
+		defer delivering.Add(-1)
+
+		var event WebhookEvent
+		json.NewDecoder(r.Body).Decode(&event)
+
+		// a slow receiver, events queue up behind each delivery
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		received = append(received, event.Event)
+		mu.Unlock()
+	}))
+	t.Cleanup(hook.Close)
+
+	server := newFakeServer(t)
+	sdkConfig := testSDKConfig(server)
+	sdkConfig.WebhookURL = hook.URL
+
+	conn, err := NewTunnelConn(testConfig(), sdkConfig, "8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startTunnel(t, server, conn)
+
+	for i := 0; i < errs; i++ {
+		conn.onError(fmt.Errorf("request %d failed", i))
+	}
+	conn.Stop()
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return len(received) == errs+2
+	})
+
+	if overlapping.Load() {
+		t.Error("webhook deliveries overlapped")
+	}
+
+	// the disconnect waits at most for the delivery in progress, not for
+	// the errors queued before it
+	if received[0] != EventConnected || !slices.Contains(received[:3], EventDisconnected) {
+		t.Errorf("events delivered as %v, want connected first and disconnected ahead of the errors", received)
+	}
+}